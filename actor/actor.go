@@ -6,6 +6,8 @@ import (
 )
 
 var ErrorInputFormat = fmt.Errorf("error input format")
+var ErrorOutputFormat = fmt.Errorf("error output format")
+var ErrorOutputClosed = fmt.Errorf("output closed")
 
 type Actor interface {
 	AsActorFn() ActorFn
@@ -25,8 +27,8 @@ func (fn ActorFn) ConnectDaemon(daemon Daemon) Daemon {
 	return NewActorDaemonConnector(fn, daemon)
 }
 
-func (fn ActorFn) AsDaemon() Daemon {
-	return NewDaemon(fn.AsDaemonFn())
+func (fn ActorFn) AsDaemon(opts ...DaemonOption) Daemon {
+	return NewDaemon(fn.AsDaemonFn(), opts...)
 }
 
 func (fn ActorFn) Run(ctx context.Context) (Daemon, error) {
@@ -35,6 +37,14 @@ func (fn ActorFn) Run(ctx context.Context) (Daemon, error) {
 
 func (fn ActorFn) AsDaemonFn() DaemonFn {
 	return func(ctx context.Context, in chan interface{}, out chan interface{}, errChan chan error) error {
+		stage := StageName(ctx)
+		if stage == "" {
+			stage = funcName(fn)
+			// the messages are counted under the name of the calls
+			ctx = withMetricsLabel(ctx, stage)
+		}
+		stats := stageFromContext(ctx).stats
+
 		for {
 			select {
 			case <-ctx.Done():
@@ -44,25 +54,33 @@ func (fn ActorFn) AsDaemonFn() DaemonFn {
 				if !ok {
 					return nil
 				}
+				observeChannels(ctx, stage, in, out)
+				stats.received()
+				observeReceived(ctx)
 
-				outData, err := fn(ctx, inData)
-				if err != nil {
-					select {
-					case <-ctx.Done():
-						return nil
-					case errChan <- err:
-						continue
+				if s, ok := inData.(sequenced); ok {
+					if stop, err := fn.callSequenced(ctx, stage, s, out, errChan); stop {
+						return err
 					}
+					continue
 				}
 
-				if outData == nil {
+				outData, err := fn.safeCallEnvelope(ctx, stage, inData)
+				if isEndOfStream(err) {
+					emit(ctx, out, outData)
 					return nil
 				}
 
-				select {
-				case <-ctx.Done():
+				if err != nil {
+					err = newStageError(stage, inData, err)
+					if err = reportError(ctx, errChan, err); err != nil {
+						return err
+					}
+					continue
+				}
+
+				if !emit(ctx, out, outData) {
 					return nil
-				case out <- outData:
 				}
 			}
 		}
@@ -78,7 +96,10 @@ func (fn ActorFn) AsActor() Actor {
 }
 
 func (fn ActorFn) Call(ctx context.Context, in interface{}) (out interface{}, err error) {
-	return fn(ctx, in)
+	ctx, in, e := openEnvelope(ctx, in)
+
+	out, err = fn(ctx, in)
+	return e.seal(out), err
 }
 
 func NewActor(fn ActorFn) Actor {
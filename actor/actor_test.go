@@ -1,10 +1,19 @@
 package actor
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"log"
+	"log/slog"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
 func TestActor_ActorPlusOne(t *testing.T) {
@@ -682,6 +691,54 @@ func TestDaemonsClusterSimple(t *testing.T) {
 	d.Wait()
 }
 
+func TestDaemonsClusterWorkerStopped(t *testing.T) {
+	// one worker ends the stream on the third call, the messages taken
+	// or queued for it go to the other workers
+	newWorker := func() Daemon {
+		var calls int32
+		return NewActor(func(ctx context.Context, in interface{}) (out interface{}, err error) {
+			time.Sleep(time.Millisecond)
+			if atomic.AddInt32(&calls, 1) == 3 {
+				return in, ErrorEndOfStream
+			}
+			return in, nil
+		}).AsActorFn().AsDaemon()
+	}
+
+	clusters := map[string]Daemon{
+		"shared":   NewDaemonsCluster(3, newWorker()),
+		"balanced": NewBalancedDaemonsCluster(3, NewRoundRobinBalancer(), newWorker(), WithInBuffer(4)),
+		"ordered":  NewOrderedDaemonsCluster(3, 4, newWorker()),
+	}
+
+	for name, prototype := range clusters {
+		d, err := prototype.Run(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		go func() {
+			for i := 0; i < 30; i++ {
+				d.In() <- i
+			}
+			close(d.In())
+		}()
+
+		var sum int
+		var count int
+		for out := range d.Out() {
+			sum += out.(int)
+			count++
+		}
+		if err := d.WaitErr(); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if count != 30 || sum != 435 {
+			t.Fatalf("%s: expected 30 messages with sum 435 actual: %d with sum %d", name, count, sum)
+		}
+	}
+}
+
 func TestDaemonsMultipleCluster(t *testing.T) {
 	intPlusOneDaemon := NewActor(func(ctx context.Context, in interface{}) (out interface{}, err error) {
 		return in.(int) + 1, nil
@@ -782,3 +839,2510 @@ func TestBroadcast(t *testing.T) {
 	broadcast.Stop()
 	broadcast.Wait()
 }
+
+func TestTypedActorConnect(t *testing.T) {
+	intPlusOne := NewTypedActor(func(ctx context.Context, in int) (int, error) {
+		return in + 1, nil
+	})
+	intToString := NewTypedActor(func(ctx context.Context, in int) (string, error) {
+		return fmt.Sprint(in), nil
+	})
+
+	intPlusTwoAsString := ConnectTypedActors(ConnectTypedActors(intPlusOne, intPlusOne), intToString)
+
+	out, err := intPlusTwoAsString.CallTyped(context.Background(), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out != "3" {
+		t.Fatalf("expected: %s actual: %s", "3", out)
+	}
+
+	// untyped stages still see the typed ones as plain actors
+	untyped := intPlusOne.ConnectActor(NewActor(func(ctx context.Context, in interface{}) (out interface{}, err error) {
+		return in.(int) * 10, nil
+	}))
+	typed := AsTypedActor[int, int](untyped)
+
+	outInt, err := typed.CallTyped(context.Background(), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if outInt != 20 {
+		t.Fatalf("expected: %d actual: %d", 20, outInt)
+	}
+
+	if _, err := intPlusOne.Call(context.Background(), "1"); err != ErrorInputFormat {
+		t.Fatalf("expected: %s actual: %v", ErrorInputFormat, err)
+	}
+	if _, err := AsTypedActor[int, string](untyped).CallTyped(context.Background(), 1); err != ErrorOutputFormat {
+		t.Fatalf("expected: %s actual: %v", ErrorOutputFormat, err)
+	}
+}
+
+func TestTypedDaemonConnect(t *testing.T) {
+	ctx := context.Background()
+
+	intPlusOne := NewTypedActor(func(ctx context.Context, in int) (int, error) {
+		return in + 1, nil
+	})
+	intToString := NewTypedDaemon(func(ctx context.Context, in chan int, out chan string, err chan error) error {
+		for inData := range in {
+			out <- fmt.Sprint(inData)
+		}
+		return nil
+	})
+
+	d, err := ConnectTypedDaemons(intPlusOne.AsTypedDaemon(), intToString).RunTyped(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := d.Send(ctx, 41); err != nil {
+		t.Fatal(err)
+	}
+
+	out, err := d.Receive(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out != "42" {
+		t.Fatalf("expected: %s actual: %s", "42", out)
+	}
+
+	// wrong input type from an untyped neighbour is reported, not a panic
+	d.In() <- "42"
+	if err := <-d.Err(); !errors.Is(err, ErrorInputFormat) {
+		t.Fatalf("expected: %s actual: %v", ErrorInputFormat, err)
+	}
+
+	d.Stop()
+	d.Wait()
+}
+
+func TestActorPanicRecovery(t *testing.T) {
+	d, err := NewActor(func(ctx context.Context, in interface{}) (out interface{}, err error) {
+		if in.(int) == 0 {
+			panic("division by zero")
+		}
+		return 10 / in.(int), nil
+	}).AsActorFn().AsDaemon().Run(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d.In() <- 0
+	err = <-d.Err()
+
+	var panicErr *PanicError
+	if !errors.As(err, &panicErr) {
+		t.Fatalf("expected PanicError actual: %v", err)
+	}
+	if panicErr.Input != 0 || panicErr.Value != "division by zero" || len(panicErr.Stack) == 0 {
+		t.Fatalf("unexpected panic error: %+v", panicErr)
+	}
+
+	// the daemon survives the panic
+	d.In() <- 5
+	if out := <-d.Out(); out != 2 {
+		t.Fatalf("expected: %d actual: %v", 2, out)
+	}
+
+	d.Stop()
+	d.Wait()
+}
+
+func TestDaemonPanicRecovery(t *testing.T) {
+	d, err := NewDaemon(func(ctx context.Context, in chan interface{}, out chan interface{}, err chan error) error {
+		var m map[string]int
+		m["boom"]++
+		return nil
+	}).Run(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var panicErr *PanicError
+	if err := <-d.Err(); !errors.As(err, &panicErr) {
+		t.Fatalf("expected PanicError actual: %v", err)
+	}
+	if panicErr.Stage == "" {
+		t.Fatal("stage is empty")
+	}
+
+	d.Wait()
+}
+
+func TestFilterKeepsDaemonRunning(t *testing.T) {
+	d, err := NewFilterActor(func(ctx context.Context, in interface{}) (keep bool, err error) {
+		return in.(int)%2 == 0, nil
+	}).AsActorFn().AsDaemon().Run(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go func() {
+		for i := 1; i <= 4; i++ {
+			d.In() <- i
+		}
+		close(d.In())
+	}()
+
+	var outs []interface{}
+	for out := range d.Out() {
+		outs = append(outs, out)
+	}
+	if len(outs) != 2 || outs[0] != 2 || outs[1] != 4 {
+		t.Fatalf("expected: [2 4] actual: %v", outs)
+	}
+
+	d.Wait()
+}
+
+func TestFlatMapAndEndOfStream(t *testing.T) {
+	repeat := NewFlatMapActor(func(ctx context.Context, in interface{}) (outs []interface{}, err error) {
+		for i := 0; i < in.(int); i++ {
+			outs = append(outs, in)
+		}
+		return outs, nil
+	})
+	untilTen := NewActor(func(ctx context.Context, in interface{}) (out interface{}, err error) {
+		if in.(int) >= 10 {
+			return in, ErrorEndOfStream
+		}
+		return in, nil
+	})
+
+	// connector-wrapped
+	out, err := repeat.ConnectActor(untilTen).Call(context.Background(), 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if outs, ok := out.(Outputs); !ok || len(outs) != 2 {
+		t.Fatalf("expected: [2 2] actual: %v", out)
+	}
+
+	out, err = repeat.ConnectActor(untilTen).Call(context.Background(), 0)
+	if err != nil || out != Drop {
+		t.Fatalf("expected: Drop actual: %v %v", out, err)
+	}
+
+	// daemon-wrapped
+	d, err := repeat.ConnectDaemon(untilTen.AsActorFn().AsDaemon()).Run(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go func() {
+		d.In() <- 0
+		d.In() <- 3
+		d.In() <- 10
+	}()
+
+	var outs []interface{}
+	for out := range d.Out() {
+		outs = append(outs, out)
+	}
+	if len(outs) != 4 || outs[0] != 3 || outs[3] != 10 {
+		t.Fatalf("expected: [3 3 3 10] actual: %v", outs)
+	}
+
+	d.Stop()
+	d.Wait()
+}
+
+func TestDaemonOptions(t *testing.T) {
+	failOnOdd := NewActor(func(ctx context.Context, in interface{}) (out interface{}, err error) {
+		if in.(int)%2 == 1 {
+			panic("odd")
+		}
+		return in, nil
+	})
+
+	d, err := failOnOdd.AsActorFn().AsDaemon(
+		WithName("even"),
+		WithInBuffer(3),
+		WithOutBuffer(2),
+		WithErrBuffer(1),
+	).Run(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if cap(d.In()) != 3 || cap(d.Out()) != 2 || cap(d.Err()) != 1 {
+		t.Fatalf("unexpected capacities: %d %d %d", cap(d.In()), cap(d.Out()), cap(d.Err()))
+	}
+	if d.Name() != "even" || d.Clone().Name() != "even" {
+		t.Fatalf("unexpected name: %s", d.Name())
+	}
+
+	d.In() <- 1
+	var panicErr *PanicError
+	if err := <-d.Err(); !errors.As(err, &panicErr) || panicErr.Stage != "even" {
+		t.Fatalf("expected panic in stage even actual: %v", err)
+	}
+
+	d.Stop()
+	d.Wait()
+
+	// connector stages keep their own options
+	c, err := NewDaemonsConnector(
+		failOnOdd.AsActorFn().AsDaemon(WithName("first"), WithBuffer(4)),
+		failOnOdd.AsActorFn().AsDaemon(WithName("second"), WithBuffer(5)),
+	).Run(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if cap(c.In()) != 4 || cap(c.Out()) != 5 {
+		t.Fatalf("unexpected capacities: %d %d", cap(c.In()), cap(c.Out()))
+	}
+	if c.Name() != "first -> second" {
+		t.Fatalf("unexpected name: %s", c.Name())
+	}
+
+	c.Stop()
+	c.Wait()
+}
+
+func TestErrorPolicyDrop(t *testing.T) {
+	d, err := NewActor(func(ctx context.Context, in interface{}) (out interface{}, err error) {
+		if in.(int) < 0 {
+			return nil, ErrorInputFormat
+		}
+		return in, nil
+	}).AsActorFn().AsDaemon(WithErrorPolicy(ErrorPolicyDrop)).Run(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// nobody reads Err(), the stage must not hang
+	d.In() <- -1
+	d.In() <- 1
+	if out := <-d.Out(); out != 1 {
+		t.Fatalf("expected: %d actual: %v", 1, out)
+	}
+
+	d.Stop()
+	d.Wait()
+}
+
+func TestErrorPolicies(t *testing.T) {
+	failOnNegative := NewActor(func(ctx context.Context, in interface{}) (out interface{}, err error) {
+		if in.(int) < 0 {
+			return nil, ErrorInputFormat
+		}
+		return in, nil
+	})
+
+	// ignore and count
+	counter := NewCountErrorPolicy()
+	d, err := failOnNegative.AsActorFn().AsDaemon(WithErrorPolicy(counter)).Run(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.In() <- -1
+	d.In() <- -2
+	d.In() <- 3
+	if out := <-d.Out(); out != 3 || counter.Count() != 2 {
+		t.Fatalf("expected: 3 and 2 errors actual: %v and %d errors", out, counter.Count())
+	}
+	d.Stop()
+	d.Wait()
+
+	// log
+	logs := &bytes.Buffer{}
+	logPolicy := NewLogErrorPolicy(slog.New(slog.NewTextHandler(logs, &slog.HandlerOptions{
+		ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr {
+			if a.Key == slog.TimeKey {
+				return slog.Attr{}
+			}
+			return a
+		},
+	})))
+	d, err = failOnNegative.AsActorFn().AsDaemon(
+		WithName("positive"),
+		WithErrorPolicy(logPolicy),
+	).Run(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.In() <- -1
+	d.In() <- 1
+	<-d.Out()
+	if logs.String() != "level=WARN msg=\"stage error\" stage=positive err=\"stage positive: error input format\"\n" {
+		t.Fatalf("unexpected log: %q", logs.String())
+	}
+	d.Stop()
+	d.Wait()
+
+	// a stage with its own logger logs the error once
+	logs.Reset()
+	stageLogs := &bytes.Buffer{}
+	d, err = failOnNegative.AsActorFn().AsDaemon(
+		WithLogger(slog.New(slog.NewTextHandler(stageLogs, nil))),
+		WithErrorPolicy(logPolicy),
+	).Run(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.In() <- -1
+	d.In() <- 1
+	<-d.Out()
+	if logs.Len() != 0 || strings.Count(stageLogs.String(), "stage error") != 1 {
+		t.Fatalf("unexpected logs: %q and %q", logs.String(), stageLogs.String())
+	}
+	d.Stop()
+	d.Wait()
+
+	// dead letter, set for the whole pipeline through the context
+	deadLetter, err := NewDaemon(func(ctx context.Context, in chan interface{}, out chan interface{}, err chan error) error {
+		for e := range in {
+			out <- e
+		}
+		return nil
+	}).Run(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := ContextWithErrorPolicy(context.Background(), NewDeadLetterErrorPolicy(deadLetter))
+	d, err = NewDaemonsConnector(
+		failOnNegative.AsActorFn().AsDaemon(WithName("first")),
+		failOnNegative.AsActorFn().AsDaemon(WithName("second")),
+	).Run(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.In() <- -5
+
+	var stageErr *StageError
+	if err, _ := (<-deadLetter.Out()).(error); !errors.As(err, &stageErr) {
+		t.Fatalf("expected StageError actual: %v", err)
+	}
+	if stageErr.Stage != "first" || stageErr.Input != -5 || stageErr.Err != ErrorInputFormat {
+		t.Fatalf("unexpected stage error: %+v", stageErr)
+	}
+	d.Stop()
+	d.Wait()
+	close(deadLetter.In())
+	deadLetter.Wait()
+}
+
+func TestErrorPolicyStopPipeline(t *testing.T) {
+	d, err := NewDaemonsConnector(
+		NewActor(func(ctx context.Context, in interface{}) (out interface{}, err error) {
+			return in, nil
+		}).AsActorFn().AsDaemon(),
+		NewActor(func(ctx context.Context, in interface{}) (out interface{}, err error) {
+			return nil, ErrorInputFormat
+		}).AsActorFn().AsDaemon(WithErrorPolicy(ErrorPolicyStop)),
+	).Run(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d.In() <- 1
+
+	// both stages stop and close their outputs
+	if _, ok := <-d.Out(); ok {
+		t.Fatal("expected closed output")
+	}
+	d.Wait()
+}
+
+func TestWaitErr(t *testing.T) {
+	errFirst := fmt.Errorf("first failed")
+	errSecond := fmt.Errorf("second failed")
+
+	d, err := NewDaemonsConnector(
+		NewDaemon(func(ctx context.Context, in chan interface{}, out chan interface{}, err chan error) error {
+			return errFirst
+		}, WithErrorPolicy(ErrorPolicyDrop)),
+		NewDaemon(func(ctx context.Context, in chan interface{}, out chan interface{}, err chan error) error {
+			for range in {
+			}
+			return errSecond
+		}, WithErrorPolicy(ErrorPolicyDrop)),
+	).Run(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = d.WaitErr()
+	if !errors.Is(err, errFirst) || !errors.Is(err, errSecond) {
+		t.Fatalf("expected both errors actual: %v", err)
+	}
+	if d.Cause() != nil {
+		t.Fatalf("expected no cause actual: %v", d.Cause())
+	}
+
+	// stopped daemons don't fail
+	d, err = NewActor(func(ctx context.Context, in interface{}) (out interface{}, err error) {
+		return in, nil
+	}).AsActorFn().AsDaemon().Run(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.Stop()
+	if err := d.WaitErr(); err != nil {
+		t.Fatal(err)
+	}
+	if d.Cause() != ErrorStopped {
+		t.Fatalf("expected: %s actual: %v", ErrorStopped, d.Cause())
+	}
+}
+
+func TestFailFast(t *testing.T) {
+	errFailed := fmt.Errorf("failed")
+
+	d, err := NewDaemonsConnector(
+		NewDaemon(func(ctx context.Context, in chan interface{}, out chan interface{}, err chan error) error {
+			<-ctx.Done()
+			return nil
+		}),
+		NewDaemonsCluster(3, NewDaemon(func(ctx context.Context, in chan interface{}, out chan interface{}, err chan error) error {
+			return errFailed
+		}, WithFailFast(), WithErrorPolicy(ErrorPolicyDrop))),
+	).Run(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the first stage is cancelled by the failed cluster workers
+	if err := d.WaitErr(); !errors.Is(err, errFailed) {
+		t.Fatalf("expected: %s actual: %v", errFailed, err)
+	}
+	if !errors.Is(d.Cause(), errFailed) {
+		t.Fatalf("expected cause: %s actual: %v", errFailed, d.Cause())
+	}
+}
+
+func TestDaemonStatus(t *testing.T) {
+	release := make(chan struct{})
+	var runCtx context.Context
+	prototype := NewDaemon(func(ctx context.Context, in chan interface{}, out chan interface{}, err chan error) error {
+		runCtx = ctx
+		<-release
+		return nil
+	})
+
+	if prototype.Status() != StatusCreated {
+		t.Fatalf("expected: %s actual: %s", StatusCreated, prototype.Status())
+	}
+
+	d, err := prototype.Run(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.Status() != StatusRunning || prototype.Status() != StatusCreated {
+		t.Fatalf("expected: %s and %s actual: %s and %s", StatusRunning, StatusCreated, d.Status(), prototype.Status())
+	}
+	if d.Clone() != d {
+		t.Fatal("running daemon must not be copied")
+	}
+	if _, err := d.Run(context.Background()); err != ErrorAlreadyLaunched {
+		t.Fatalf("expected: %s actual: %v", ErrorAlreadyLaunched, err)
+	}
+
+	close(release)
+	d.Wait()
+	if d.Status() != StatusStopped {
+		t.Fatalf("expected: %s actual: %s", StatusStopped, d.Status())
+	}
+	// the context of a stopped daemon is released, the cause isn't changed
+	if runCtx.Err() == nil || d.Cause() != nil {
+		t.Fatalf("expected released context actual: %v cause: %v", runCtx.Err(), d.Cause())
+	}
+
+	// a stopped instance runs again with a new output instead of the closed one
+	d, err = NewDaemon(func(ctx context.Context, in chan interface{}, out chan interface{}, err chan error) error {
+		for range in {
+		}
+		return nil
+	}).Run(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	close(d.In())
+	d.Wait()
+
+	d, err = d.Run(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.Wait()
+	if _, ok := <-d.Out(); ok {
+		t.Fatal("expected closed output")
+	}
+
+	d, err = NewDaemon(func(ctx context.Context, in chan interface{}, out chan interface{}, err chan error) error {
+		return ErrorInputFormat
+	}, WithErrorPolicy(ErrorPolicyDrop)).Run(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.Wait()
+	if d.Status() != StatusFailed {
+		t.Fatalf("expected: %s actual: %s", StatusFailed, d.Status())
+	}
+}
+
+func TestIdempotentLifecycle(t *testing.T) {
+	intPlusOne := NewActor(func(ctx context.Context, in interface{}) (out interface{}, err error) {
+		return in.(int) + 1, nil
+	}).AsActorFn()
+
+	daemons := map[string]Daemon{
+		"daemon":    intPlusOne.AsDaemon(),
+		"connector": intPlusOne.ConnectDaemon(intPlusOne.AsDaemon()),
+		"cluster":   NewDaemonsCluster(3, intPlusOne.AsDaemon()),
+	}
+
+	for name, prototype := range daemons {
+		d, err := prototype.Run(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		d.In() <- 1
+		if out := <-d.Out(); out.(int) < 2 {
+			t.Fatalf("%s: unexpected output: %v", name, out)
+		}
+
+		d.Close()
+		d.Close()
+		d.Stop()
+		d.Stop()
+		d.Wait()
+		d.Wait()
+
+		if d.Status() != StatusStopped {
+			t.Fatalf("%s: expected: %s actual: %s", name, StatusStopped, d.Status())
+		}
+	}
+}
+
+func TestDrain(t *testing.T) {
+	slowPlusOne := NewActor(func(ctx context.Context, in interface{}) (out interface{}, err error) {
+		time.Sleep(time.Millisecond)
+		return in.(int) + 1, nil
+	}).AsActorFn()
+
+	d, err := NewDaemonsConnector(
+		slowPlusOne.AsDaemon(WithBuffer(10)),
+		NewDaemonsCluster(3, slowPlusOne.AsDaemon(), WithBuffer(10)),
+	).Run(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 10; i++ {
+		d.In() <- i
+	}
+
+	outs := make(chan int)
+	go func() {
+		var count int
+		for range d.Out() {
+			count++
+		}
+		outs <- count
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if err := d.Drain(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if count := <-outs; count != 10 {
+		t.Fatalf("expected: %d actual: %d", 10, count)
+	}
+	if d.Status() != StatusStopped {
+		t.Fatalf("expected: %s actual: %s", StatusStopped, d.Status())
+	}
+}
+
+func TestDrainDeadline(t *testing.T) {
+	d, err := NewDaemonsConnector(
+		NewActor(func(ctx context.Context, in interface{}) (out interface{}, err error) {
+			return in, nil
+		}).AsActorFn().AsDaemon(WithName("pass")),
+		NewActor(func(ctx context.Context, in interface{}) (out interface{}, err error) {
+			<-ctx.Done()
+			return nil, ctx.Err()
+		}).AsActorFn().AsDaemon(WithName("stuck")),
+	).Run(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d.In() <- 1
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	var drainErr *DrainError
+	if err := d.Drain(ctx); !errors.As(err, &drainErr) {
+		t.Fatalf("expected DrainError actual: %v", err)
+	}
+	if len(drainErr.Busy) != 1 || drainErr.Busy[0] != "stuck" {
+		t.Fatalf("expected busy stage stuck actual: %v", drainErr.Busy)
+	}
+	if !errors.Is(drainErr, context.DeadlineExceeded) {
+		t.Fatalf("expected: %s actual: %v", context.DeadlineExceeded, drainErr.Err)
+	}
+	if !d.Status().IsDone() {
+		t.Fatalf("expected stopped daemon actual: %s", d.Status())
+	}
+}
+
+func TestSupervisorRestart(t *testing.T) {
+	var starts int32
+
+	failOnZero := NewDaemon(func(ctx context.Context, in chan interface{}, out chan interface{}, err chan error) error {
+		atomic.AddInt32(&starts, 1)
+		for inData := range in {
+			if inData.(int) == 0 {
+				return ErrorInputFormat
+			}
+			out <- 10 / inData.(int)
+		}
+		return nil
+	})
+	plusOne := NewActor(func(ctx context.Context, in interface{}) (out interface{}, err error) {
+		return in.(int) + 1, nil
+	}).AsActorFn().AsDaemon()
+
+	d, err := NewSupervisor(
+		[]Daemon{failOnZero, plusOne},
+		WithBackoff(time.Millisecond, 10*time.Millisecond),
+		WithSupervisorDaemonOptions(WithErrorPolicy(ErrorPolicyDrop)),
+	).Run(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d.In() <- 5
+	if out := <-d.Out(); out != 3 {
+		t.Fatalf("expected: %d actual: %v", 3, out)
+	}
+
+	// the failed child is restarted on the same channels
+	d.In() <- 0
+	d.In() <- 2
+	if out := <-d.Out(); out != 6 {
+		t.Fatalf("expected: %d actual: %v", 6, out)
+	}
+	if atomic.LoadInt32(&starts) != 2 {
+		t.Fatalf("expected: %d starts actual: %d", 2, starts)
+	}
+
+	close(d.In())
+	if err := d.WaitErr(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSupervisorRestartBlockingPolicy(t *testing.T) {
+	failOnZero := NewDaemon(func(ctx context.Context, in chan interface{}, out chan interface{}, err chan error) error {
+		for inData := range in {
+			if inData.(int) == 0 {
+				return ErrorInputFormat
+			}
+			out <- inData
+		}
+		return nil
+	})
+
+	// nobody reads Err() until the restarted child answers
+	d, err := NewSupervisor([]Daemon{failOnZero}, WithBackoff(time.Millisecond, time.Millisecond)).
+		Run(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d.In() <- 0
+	d.In() <- 7
+	select {
+	case out := <-d.Out():
+		if out != 7 {
+			t.Fatalf("expected: 7 actual: %v", out)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("the failed child is not restarted")
+	}
+
+	if err := <-d.Err(); !errors.Is(err, ErrorInputFormat) {
+		t.Fatalf("expected: %s actual: %v", ErrorInputFormat, err)
+	}
+
+	close(d.In())
+	d.Wait()
+}
+
+func TestSupervisorRestartIntensity(t *testing.T) {
+	var firstStarts, secondStarts int32
+
+	alwaysFail := NewDaemon(func(ctx context.Context, in chan interface{}, out chan interface{}, err chan error) error {
+		atomic.AddInt32(&secondStarts, 1)
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-in:
+			return ErrorInputFormat
+		}
+	})
+	pass := NewDaemon(func(ctx context.Context, in chan interface{}, out chan interface{}, err chan error) error {
+		atomic.AddInt32(&firstStarts, 1)
+		return NewActor(func(ctx context.Context, in interface{}) (out interface{}, err error) {
+			return in, nil
+		}).AsActorFn().AsDaemonFn()(ctx, in, out, err)
+	})
+
+	child := NewSupervisor(
+		[]Daemon{pass, alwaysFail},
+		WithRestartStrategy(OneForAll),
+		WithMaxRestarts(2, time.Minute),
+		WithBackoff(0, 0),
+		WithSupervisorDaemonOptions(WithErrorPolicy(ErrorPolicyDrop)),
+	)
+
+	// the child supervisor escalates to the parent, the parent gives up too
+	d, err := NewSupervisor(
+		[]Daemon{child},
+		WithMaxRestarts(0, time.Minute),
+		WithSupervisorDaemonOptions(WithErrorPolicy(ErrorPolicyDrop)),
+	).Run(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// messages in flight of the restarted children are lost, so keep sending
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		for i := 0; ; i++ {
+			select {
+			case <-done:
+				return
+			case d.In() <- i:
+			}
+		}
+	}()
+
+	if err := d.WaitErr(); !errors.Is(err, ErrorRestartIntensity) || !errors.Is(err, ErrorInputFormat) {
+		t.Fatalf("expected: %s actual: %v", ErrorRestartIntensity, err)
+	}
+	if atomic.LoadInt32(&firstStarts) != 3 || atomic.LoadInt32(&secondStarts) != 3 {
+		t.Fatalf("expected 3 starts of every child actual: %d %d", firstStarts, secondStarts)
+	}
+}
+
+func TestOrderedDaemonsCluster(t *testing.T) {
+	worker := NewActor(func(ctx context.Context, in interface{}) (out interface{}, err error) {
+		i := in.(int)
+		time.Sleep(time.Duration((i*7)%5) * time.Millisecond)
+
+		switch {
+		case i%10 == 3:
+			return Drop, nil
+		case i%10 == 5:
+			return nil, ErrorInputFormat
+		case i%10 == 7:
+			return Outputs{i, i}, nil
+		}
+		return i, nil
+	}).AsActorFn().AsDaemon()
+
+	d, err := NewOrderedDaemonsCluster(4, 8, worker, WithErrorPolicy(ErrorPolicyDrop)).Run(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go func() {
+		for i := 0; i < 100; i++ {
+			d.In() <- i
+		}
+		close(d.In())
+	}()
+
+	var expected []int
+	for i := 0; i < 100; i++ {
+		switch i % 10 {
+		case 3, 5:
+		case 7:
+			expected = append(expected, i, i)
+		default:
+			expected = append(expected, i)
+		}
+	}
+
+	var actual []int
+	for out := range d.Out() {
+		actual = append(actual, out.(int))
+	}
+
+	if fmt.Sprint(actual) != fmt.Sprint(expected) {
+		t.Fatalf("expected: %v actual: %v", expected, actual)
+	}
+	if err := d.WaitErr(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestOrderedDaemonsClusterNoWorkers(t *testing.T) {
+	// the only worker ends the stream while the cluster holds the next message,
+	// which is reported and skipped
+	release := make(chan struct{})
+	worker := NewActor(func(ctx context.Context, in interface{}) (out interface{}, err error) {
+		if in.(int) == 2 {
+			<-release
+			return in, ErrorEndOfStream
+		}
+		return in, nil
+	}).AsActorFn().AsDaemon()
+
+	d, err := NewOrderedDaemonsCluster(1, 8, worker, WithOutBuffer(10), WithErrorPolicy(ErrorPolicyDrop)).Run(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the cluster has taken 3 when the input takes 4
+	for i := 0; i < 5; i++ {
+		d.In() <- i
+	}
+	close(release)
+
+	var actual []int
+	for out := range d.Out() {
+		actual = append(actual, out.(int))
+	}
+	if fmt.Sprint(actual) != "[0 1 2]" {
+		t.Fatalf("expected: [0 1 2] actual: %v", actual)
+	}
+	if err := d.WaitErr(); !errors.Is(err, ErrorNoWorkers) {
+		t.Fatalf("expected: %s actual: %v", ErrorNoWorkers, err)
+	}
+}
+
+func TestOrderedDaemonsClusterBound(t *testing.T) {
+	release := make(chan struct{})
+	worker := NewActor(func(ctx context.Context, in interface{}) (out interface{}, err error) {
+		if in.(int) == 0 {
+			<-release
+		}
+		return in, nil
+	}).AsActorFn().AsDaemon()
+
+	d, err := NewOrderedDaemonsCluster(4, 2, worker).Run(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d.In() <- 0
+	d.In() <- 1
+
+	// the slow message holds back the input
+	select {
+	case d.In() <- 2:
+		t.Fatal("input is not bounded")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(release)
+	d.In() <- 2
+
+	for i := 0; i < 3; i++ {
+		if out := <-d.Out(); out != i {
+			t.Fatalf("expected: %d actual: %v", i, out)
+		}
+	}
+
+	d.Stop()
+	d.Wait()
+}
+
+func TestPartitionedCluster(t *testing.T) {
+	var workers int32
+	worker := NewDaemon(func(ctx context.Context, in chan interface{}, out chan interface{}, err chan error) error {
+		id := atomic.AddInt32(&workers, 1)
+		for inData := range in {
+			out <- [2]interface{}{id, inData}
+		}
+		return nil
+	})
+
+	d, err := NewPartitionedCluster(4, func(in interface{}) string {
+		return in.(string)[:1]
+	}, worker).Run(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go func() {
+		for i := 0; i < 100; i++ {
+			d.In() <- fmt.Sprintf("%c%02d", 'a'+i%8, i)
+		}
+		close(d.In())
+	}()
+
+	keyWorkers := map[byte]interface{}{}
+	last := map[byte]string{}
+	for out := range d.Out() {
+		id, msg := out.([2]interface{})[0], out.([2]interface{})[1].(string)
+		key := msg[0]
+
+		if w, ok := keyWorkers[key]; ok && w != id {
+			t.Fatalf("key %c processed by workers %v and %v", key, w, id)
+		}
+		keyWorkers[key] = id
+
+		if msg <= last[key] {
+			t.Fatalf("%s after %s", msg, last[key])
+		}
+		last[key] = msg
+	}
+
+	if len(last) != 8 {
+		t.Fatalf("expected: %d keys actual: %d", 8, len(last))
+	}
+	if err := d.WaitErr(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPartitionedClusterNoWorkers(t *testing.T) {
+	release := make(chan struct{})
+	worker := NewDaemon(func(ctx context.Context, in chan interface{}, out chan interface{}, err chan error) error {
+		out <- <-in
+		<-release
+		return nil
+	})
+
+	d, err := NewPartitionedCluster(1, func(in interface{}) string {
+		return in.(string)
+	}, worker).Run(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d.In() <- "a"
+	<-d.Out()
+
+	// the cluster holds the message when the only worker stops
+	d.In() <- "b"
+	close(release)
+
+	err = <-d.Err()
+	var stageErr *StageError
+	if !errors.Is(err, ErrorNoWorkers) || !errors.As(err, &stageErr) || stageErr.Input != "b" {
+		t.Fatalf("expected: %s for b actual: %v", ErrorNoWorkers, err)
+	}
+	if err := d.WaitErr(); !errors.Is(err, ErrorNoWorkers) {
+		t.Fatalf("expected: %s actual: %v", ErrorNoWorkers, err)
+	}
+}
+
+func TestHashRing(t *testing.T) {
+	ring := &hashRing{}
+	for id := 0; id < 4; id++ {
+		ring.add(id)
+	}
+
+	owners := map[string]int{}
+	for i := 0; i < 1000; i++ {
+		key := fmt.Sprint(i)
+		owners[key] = ring.get(key)
+	}
+
+	// only the keys of the removed worker move
+	ring.remove(2)
+	for key, id := range owners {
+		moved := ring.get(key)
+		if id != 2 && moved != id || moved == 2 {
+			t.Fatalf("key %s moved from %d to %d", key, id, moved)
+		}
+	}
+}
+
+func TestDaemonsClusterResize(t *testing.T) {
+	var running, maxRunning int32
+	worker := NewActor(func(ctx context.Context, in interface{}) (out interface{}, err error) {
+		n := atomic.AddInt32(&running, 1)
+		defer atomic.AddInt32(&running, -1)
+
+		for m := atomic.LoadInt32(&maxRunning); n > m; m = atomic.LoadInt32(&maxRunning) {
+			atomic.CompareAndSwapInt32(&maxRunning, m, n)
+		}
+
+		time.Sleep(2 * time.Millisecond)
+		return in, nil
+	}).AsActorFn().AsDaemon()
+
+	d, err := NewDaemonsCluster(1, worker).RunCluster(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := d.Resize(3); err != nil {
+		t.Fatal(err)
+	}
+	if d.Size() != 3 {
+		t.Fatalf("expected: %d workers actual: %d", 3, d.Size())
+	}
+
+	go func() {
+		for i := 0; i < 30; i++ {
+			d.In() <- i
+		}
+		close(d.In())
+	}()
+
+	var sum int
+	for i := 0; i < 10; i++ {
+		sum += (<-d.Out()).(int)
+	}
+
+	// retired workers finish their messages
+	if err := d.Resize(1); err != nil {
+		t.Fatal(err)
+	}
+	if d.Size() != 1 {
+		t.Fatalf("expected: %d workers actual: %d", 1, d.Size())
+	}
+
+	for out := range d.Out() {
+		sum += out.(int)
+	}
+	if sum != 435 {
+		t.Fatalf("expected: %d actual: %d", 435, sum)
+	}
+	if atomic.LoadInt32(&maxRunning) != 3 {
+		t.Fatalf("expected: %d workers running actual: %d", 3, maxRunning)
+	}
+
+	if err := d.WaitErr(); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Resize(2); err != ErrorStopped {
+		t.Fatalf("expected: %s actual: %v", ErrorStopped, err)
+	}
+}
+
+func TestAutoscale(t *testing.T) {
+	worker := NewActor(func(ctx context.Context, in interface{}) (out interface{}, err error) {
+		time.Sleep(5 * time.Millisecond)
+		return in, nil
+	}).AsActorFn().AsDaemon()
+
+	d, err := NewDaemonsCluster(1, worker, WithInBuffer(100)).RunCluster(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := Autoscale(d, 1, 4, time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+
+	go func() {
+		for i := 0; i < 200; i++ {
+			d.In() <- i
+		}
+	}()
+
+	var maxSize int
+	for i := 0; i < 200; i++ {
+		<-d.Out()
+		if size := d.Size(); size > maxSize {
+			maxSize = size
+		}
+	}
+	if maxSize != 4 {
+		t.Fatalf("expected: %d workers actual: %d", 4, maxSize)
+	}
+
+	// idle cluster shrinks
+	deadline := time.After(time.Second)
+	for d.Size() != 1 {
+		select {
+		case <-deadline:
+			t.Fatalf("expected: %d workers actual: %d", 1, d.Size())
+		case <-time.After(time.Millisecond):
+		}
+	}
+
+	d.Stop()
+	d.Wait()
+}
+
+func TestBalancedDaemonsCluster(t *testing.T) {
+	balancers := map[string]Balancer{
+		"round-robin":       NewRoundRobinBalancer(),
+		"least-outstanding": BalancerLeastOutstanding,
+		"power-of-two":      BalancerPowerOfTwo,
+		"work-stealing":     NewWorkStealingBalancer(),
+	}
+
+	for name, balancer := range balancers {
+		var workers int32
+		worker := NewDaemon(func(ctx context.Context, in chan interface{}, out chan interface{}, err chan error) error {
+			id := atomic.AddInt32(&workers, 1)
+			for inData := range in {
+				// the first worker is slow
+				if id == 1 {
+					time.Sleep(5 * time.Millisecond)
+				}
+				out <- [2]interface{}{id, inData}
+			}
+			return nil
+		})
+
+		d, err := NewBalancedDaemonsCluster(4, balancer, worker, WithInBuffer(4)).RunCluster(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		go func() {
+			for i := 0; i < 100; i++ {
+				d.In() <- i
+			}
+			close(d.In())
+		}()
+
+		processed := map[interface{}]int{}
+		var sum int
+		for out := range d.Out() {
+			processed[out.([2]interface{})[0]]++
+			sum += out.([2]interface{})[1].(int)
+		}
+
+		if sum != 4950 {
+			t.Fatalf("%s expected: %d actual: %d", name, 4950, sum)
+		}
+		if len(processed) < 2 {
+			t.Fatalf("%s expected the messages spread over the workers actual: %v", name, processed)
+		}
+		if name != "round-robin" && processed[int32(1)] >= 25 {
+			t.Fatalf("%s expected the slow worker to get less messages actual: %v", name, processed)
+		}
+		if err := d.WaitErr(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestBalancedDaemonsClusterInFlight(t *testing.T) {
+	release := make(chan struct{})
+	worker := NewActor(func(ctx context.Context, in interface{}) (out interface{}, err error) {
+		<-release
+		return in, nil
+	}).AsActorFn().AsDaemon()
+
+	d, err := NewBalancedDaemonsCluster(2, NewRoundRobinBalancer(), worker, WithInBuffer(4)).RunCluster(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 6; i++ {
+		d.In() <- i
+	}
+
+	// every worker processes one message and has two more waiting
+	deadline := time.After(time.Second)
+	for fmt.Sprint(d.InFlight()) != "[3 3]" {
+		select {
+		case <-deadline:
+			t.Fatalf("expected: %v actual: %v", []int{3, 3}, d.InFlight())
+		case <-time.After(time.Millisecond):
+		}
+	}
+
+	if err := d.Resize(1); err != nil {
+		t.Fatal(err)
+	}
+	close(release)
+
+	// the retired worker finishes its queue
+	for i := 0; i < 6; i++ {
+		<-d.Out()
+	}
+
+	close(d.In())
+	if err := d.WaitErr(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLeastOutstandingSlowWorker(t *testing.T) {
+	release := make(chan struct{})
+	worker := NewActor(func(ctx context.Context, in interface{}) (out interface{}, err error) {
+		if in.(int) == 0 {
+			<-release
+		}
+		return in, nil
+	}).AsActorFn().AsDaemon()
+
+	d, err := NewBalancedDaemonsCluster(2, BalancerLeastOutstanding, worker).RunCluster(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the first worker is busy with a slow call, the feeder doesn't hold the message anymore
+	d.In() <- 0
+	deadline := time.After(time.Second)
+	for d.Stats().InFlight != 1 || fmt.Sprint(d.InFlight()) != "[1 0]" {
+		select {
+		case <-deadline:
+			t.Fatalf("expected: %v actual: %v", []int{1, 0}, d.InFlight())
+		case <-time.After(time.Millisecond):
+		}
+	}
+
+	// the next message goes to the idle worker
+	d.In() <- 1
+	select {
+	case out := <-d.Out():
+		if out != 1 {
+			t.Fatalf("expected: 1 actual: %v", out)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("the message waits for the busy worker")
+	}
+
+	close(release)
+	if out := <-d.Out(); out != 0 {
+		t.Fatalf("expected: 0 actual: %v", out)
+	}
+
+	close(d.In())
+	if err := d.WaitErr(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDaemonsClusterWithFactory(t *testing.T) {
+	var created int32
+	d, err := NewDaemonsClusterWithFactory(3, func(workerID int) Daemon {
+		atomic.AddInt32(&created, 1)
+
+		// every worker has its own sum
+		var sum int
+		return NewActor(func(ctx context.Context, in interface{}) (out interface{}, err error) {
+			if ClusterName(ctx) != "adders" {
+				return nil, fmt.Errorf("unexpected cluster %q", ClusterName(ctx))
+			}
+			if WorkerID(ctx) != workerID {
+				return nil, fmt.Errorf("worker %d runs in the context of %d", workerID, WorkerID(ctx))
+			}
+
+			sum += in.(int)
+			return [2]int{workerID, sum}, nil
+		}).AsActorFn().AsDaemon()
+	}, WithName("adders")).Run(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go func() {
+		for i := 0; i < 30; i++ {
+			d.In() <- 1
+		}
+		close(d.In())
+	}()
+
+	sums := map[int]int{}
+	for out := range d.Out() {
+		id, sum := out.([2]int)[0], out.([2]int)[1]
+		if sum != sums[id]+1 {
+			t.Fatalf("worker %d expected sum: %d actual: %d", id, sums[id]+1, sum)
+		}
+		sums[id] = sum
+	}
+
+	if err := d.WaitErr(); err != nil {
+		t.Fatal(err)
+	}
+	if created != 3 {
+		t.Fatalf("expected: %d workers actual: %d", 3, created)
+	}
+	if WorkerID(context.Background()) != -1 {
+		t.Fatal("expected no worker outside of a cluster")
+	}
+}
+
+func TestBroadcastSlowSubscribers(t *testing.T) {
+	release := make(chan struct{})
+	stuck := NewActor(func(ctx context.Context, in interface{}) (out interface{}, err error) {
+		<-release
+		return in, nil
+	}).AsActorFn().AsDaemon()
+	fast := NewActor(func(ctx context.Context, in interface{}) (out interface{}, err error) {
+		return in, nil
+	}).AsActorFn().AsDaemon(WithOutBuffer(10))
+
+	fastOut := make(chan interface{}, 10)
+	dropNewestOut := make(chan interface{}, 10)
+	dropOldestOut := make(chan interface{}, 10)
+	disconnectOut := make(chan interface{}, 10)
+
+	d, err := NewBroadcastDaemon(
+		fast.SetOut(fastOut),
+		NewBroadcastSubscriber(stuck.Clone().SetOut(dropNewestOut), 2, SlowSubscriberDropNewest),
+		NewBroadcastSubscriber(stuck.Clone().SetOut(dropOldestOut), 2, SlowSubscriberDropOldest),
+		NewBroadcastSubscriber(stuck.Clone().SetOut(disconnectOut), 1, SlowSubscriberDisconnect),
+	).Run(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	errs := make(chan error, 10)
+	go func() {
+		for err := range d.Err() {
+			errs <- err
+		}
+	}()
+
+	// stuck subscribers don't stall the fast one
+	for i := 0; i < 5; i++ {
+		d.In() <- i
+		if out := <-fastOut; out != i {
+			t.Fatalf("expected: %d actual: %v", i, out)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if err := <-errs; !errors.Is(err, ErrorSlowSubscriber) {
+		t.Fatalf("expected: %s actual: %v", ErrorSlowSubscriber, err)
+	}
+
+	close(release)
+	close(d.In())
+	if err := d.WaitErr(); err != nil {
+		t.Fatal(err)
+	}
+
+	read := func(c chan interface{}) string {
+		var outs []interface{}
+		for len(c) > 0 {
+			outs = append(outs, <-c)
+		}
+		return fmt.Sprint(outs)
+	}
+
+	// one message in the subscriber, one waiting for it and two buffered
+	if outs := read(dropNewestOut); outs != "[0 1 2 3]" {
+		t.Fatalf("expected: %s actual: %s", "[0 1 2 3]", outs)
+	}
+	if outs := read(dropOldestOut); outs != "[0 1 3 4]" {
+		t.Fatalf("expected: %s actual: %s", "[0 1 3 4]", outs)
+	}
+	if outs := read(disconnectOut); outs != "[0 1 2]" {
+		t.Fatalf("expected: %s actual: %s", "[0 1 2]", outs)
+	}
+}
+
+func TestBroadcastSubscriberClone(t *testing.T) {
+	sub := NewActor(func(ctx context.Context, in interface{}) (out interface{}, err error) {
+		return in, nil
+	}).AsActorFn().AsDaemon()
+
+	prototype := NewBroadcastDaemon(sub)
+	for i := 0; i < 2; i++ {
+		d, err := prototype.Run(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		d.Stop()
+		d.Wait()
+
+		if sub.Err() != nil || sub.IsLaunched() {
+			t.Fatal("the subscriber must not be changed by the broadcast")
+		}
+	}
+}
+
+func TestBroadcastOptions(t *testing.T) {
+	sub := NewActor(func(ctx context.Context, in interface{}) (out interface{}, err error) {
+		return in, nil
+	}).AsActorFn().AsDaemon()
+
+	d, err := NewBroadcastDaemonWithOptions([]Daemon{sub}, WithName("fanout"), WithInBuffer(2)).Run(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.Name() != "fanout" || cap(d.In()) != 2 {
+		t.Fatalf("unexpected broadcast: %s with input of %d", d.Name(), cap(d.In()))
+	}
+	d.Stop()
+	d.Wait()
+
+	broadcast, cluster := NewDaemonsClusterWithBroadcast(2, sub, WithName("workers"))
+	if broadcast.Name() != "workers" || cluster.Name() != "workers" {
+		t.Fatalf("expected workers actual: %s and %s", broadcast.Name(), cluster.Name())
+	}
+}
+
+func TestBroadcastClusterWithFactory(t *testing.T) {
+	broadcast, cluster := NewDaemonsClusterWithBroadcastFactory(3, func(workerID int) Daemon {
+		return NewActor(func(ctx context.Context, in interface{}) (out interface{}, err error) {
+			return in.(int) + WorkerID(ctx), nil
+		}).AsActorFn().AsDaemon()
+	})
+
+	cluster, err := cluster.Run(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	broadcast, err = broadcast.Run(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// every worker gets the message
+	broadcast.In() <- 10
+	var sum int
+	for i := 0; i < 3; i++ {
+		sum += (<-cluster.Out()).(int)
+	}
+	if sum != 33 {
+		t.Fatalf("expected: %d actual: %d", 33, sum)
+	}
+
+	close(broadcast.In())
+	if err := broadcast.WaitErr(); err != nil {
+		t.Fatal(err)
+	}
+	if err := cluster.WaitErr(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestBus(t *testing.T) {
+	bus := NewBus()
+
+	created, err := bus.Subscribe("orders.*.created", WithInBuffer(10)).Run(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	orders, err := bus.Subscribe("orders.#", WithInBuffer(10)).
+		ConnectActor(NewActor(func(ctx context.Context, in interface{}) (out interface{}, err error) {
+			return "order " + in.(string), nil
+		})).
+		Run(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the output of a daemon is published
+	publisher, err := NewActor(func(ctx context.Context, in interface{}) (out interface{}, err error) {
+		return in, nil
+	}).ConnectDaemon(bus.PublisherFn(func(msg interface{}) string {
+		return msg.(string)
+	})).Run(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, topic := range []string{"orders.1.created", "orders.1.paid", "payments.1.created", "orders", "orders.1.2.created"} {
+		publisher.In() <- topic
+	}
+
+	if out := <-created.Out(); out != "orders.1.created" {
+		t.Fatalf("expected: %s actual: %v", "orders.1.created", out)
+	}
+	for _, expected := range []string{"order orders.1.created", "order orders.1.paid", "order orders", "order orders.1.2.created"} {
+		if out := <-orders.Out(); out != expected {
+			t.Fatalf("expected: %s actual: %v", expected, out)
+		}
+	}
+
+	// unsubscribed daemon stops
+	bus.Unsubscribe(created)
+	if _, ok := <-created.Out(); ok {
+		t.Fatal("expected closed output")
+	}
+	if err := bus.Publish(context.Background(), "orders.2.created", "orders.2.created"); err != nil {
+		t.Fatal(err)
+	}
+	if out := <-orders.Out(); out != "order orders.2.created" {
+		t.Fatalf("expected: %s actual: %v", "order orders.2.created", out)
+	}
+
+	bus.Unsubscribe(orders)
+	orders.Wait()
+	close(publisher.In())
+	publisher.Wait()
+}
+
+func TestMatchTopic(t *testing.T) {
+	cases := []struct {
+		pattern string
+		topic   string
+		match   bool
+	}{
+		{"orders.*.created", "orders.1.created", true},
+		{"orders.*.created", "orders.1.2.created", false},
+		{"orders.#.created", "orders.1.2.created", true},
+		{"orders.#.created", "orders.created", true},
+		{"orders.#", "orders", true},
+		{"#", "orders.1", true},
+		{"orders.*", "orders", false},
+		{"orders", "payments", false},
+	}
+
+	for _, c := range cases {
+		if matchTopic(strings.Split(c.pattern, "."), strings.Split(c.topic, ".")) != c.match {
+			t.Fatalf("pattern %s topic %s expected: %v", c.pattern, c.topic, c.match)
+		}
+	}
+}
+
+func TestRouter(t *testing.T) {
+	timesTen := NewActor(func(ctx context.Context, in interface{}) (out interface{}, err error) {
+		return in.(int) * 10, nil
+	}).AsActorFn().AsDaemon()
+	negate := NewActor(func(ctx context.Context, in interface{}) (out interface{}, err error) {
+		return -in.(int), nil
+	}).AsActorFn().AsDaemon()
+
+	oddOut := make(chan interface{}, 10)
+	odd := NewActor(func(ctx context.Context, in interface{}) (out interface{}, err error) {
+		return in, nil
+	}).AsActorFn().AsDaemon().SetOut(oddOut)
+
+	d, err := NewRouter(
+		RouteFirst(
+			RoutePredicate{Branch: "negative", Match: func(msg interface{}) bool { return msg.(int) < 0 }},
+			RoutePredicate{Branch: "odd", Match: func(msg interface{}) bool { return msg.(int)%2 != 0 }},
+		),
+		map[string]Daemon{
+			"negative":    negate,
+			"odd":         odd,
+			DefaultBranch: timesTen,
+		},
+	).Run(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, i := range []int{2, -3, 5} {
+		d.In() <- i
+	}
+
+	// branches without their own output write to the router output
+	outs := map[interface{}]bool{}
+	outs[<-d.Out()] = true
+	outs[<-d.Out()] = true
+	if !outs[20] || !outs[3] {
+		t.Fatalf("expected: %v actual: %v", []int{20, 3}, outs)
+	}
+	if out := <-oddOut; out != 5 {
+		t.Fatalf("expected: %d actual: %v", 5, out)
+	}
+
+	// Stop reaches every branch
+	d.Stop()
+	if err := d.WaitErr(); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := <-d.Out(); ok {
+		t.Fatal("expected closed output")
+	}
+}
+
+func TestRouterNoRoute(t *testing.T) {
+	d, err := NewRouter(func(ctx context.Context, msg interface{}) (string, error) {
+		return "unknown", nil
+	}, map[string]Daemon{}).Run(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d.In() <- 1
+	if err := <-d.Err(); !errors.Is(err, ErrorNoRoute) {
+		t.Fatalf("expected: %s actual: %v", ErrorNoRoute, err)
+	}
+
+	close(d.In())
+	d.Wait()
+}
+
+func TestMergeDaemon(t *testing.T) {
+	generator := func(from int) Daemon {
+		return NewDaemon(func(ctx context.Context, in chan interface{}, out chan interface{}, err chan error) error {
+			for i := from; i < from+3; i++ {
+				out <- i
+			}
+			return nil
+		})
+	}
+
+	d, err := NewMergeDaemon(generator(0), generator(10), generator(20)).
+		ConnectActor(NewActor(func(ctx context.Context, in interface{}) (out interface{}, err error) {
+			return in.(int) + 1, nil
+		})).
+		Run(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the output is closed after every upstream and the merge input
+	close(d.In())
+	var sum int
+	for out := range d.Out() {
+		sum += out.(int)
+	}
+	if sum != 108 {
+		t.Fatalf("expected: %d actual: %d", 108, sum)
+	}
+	if err := d.WaitErr(); err != nil {
+		t.Fatal(err)
+	}
+
+	// without upstreams the merge passes its input
+	d, err = NewMergeDaemonWithOptions(nil, WithName("merge"), WithOutBuffer(2)).Run(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.In() <- 1
+	d.In() <- 2
+	close(d.In())
+	if out := <-d.Out(); out != 1 || d.Name() != "merge" {
+		t.Fatalf("expected: 1 of merge actual: %v of %s", out, d.Name())
+	}
+	if out := <-d.Out(); out != 2 {
+		t.Fatalf("expected: 2 actual: %v", out)
+	}
+	d.Wait()
+}
+
+func TestMergeDaemonInput(t *testing.T) {
+	generator := NewDaemon(func(ctx context.Context, in chan interface{}, out chan interface{}, err chan error) error {
+		for i := 1; i <= 3; i++ {
+			out <- i
+		}
+		return nil
+	})
+	times10 := NewActor(func(ctx context.Context, in interface{}) (out interface{}, err error) {
+		return in.(int) * 10, nil
+	}).AsActorFn().AsDaemon()
+
+	// the merge input is merged with the upstreams
+	d, err := times10.ConnectDaemon(NewMergeDaemon(generator)).Run(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d.In() <- 1
+	d.In() <- 2
+	close(d.In())
+
+	var sum int
+	for out := range d.Out() {
+		sum += out.(int)
+	}
+	if sum != 36 {
+		t.Fatalf("expected: %d actual: %d", 36, sum)
+	}
+}
+
+func TestMergeDaemonStop(t *testing.T) {
+	pass := NewActor(func(ctx context.Context, in interface{}) (out interface{}, err error) {
+		return in, nil
+	}).AsActorFn().AsDaemon()
+
+	// an upstream launched before the merge
+	launched, err := pass.Run(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d, err := NewMergeDaemon(pass, launched).Run(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	launched.In() <- 1
+	if out := <-d.Out(); out != 1 {
+		t.Fatalf("expected: %d actual: %v", 1, out)
+	}
+
+	d.Stop()
+	d.Wait()
+	if launched.Status() != StatusStopped {
+		t.Fatalf("expected: %s actual: %s", StatusStopped, launched.Status())
+	}
+	if _, ok := <-d.Out(); ok {
+		t.Fatal("expected closed output")
+	}
+}
+
+func TestGraph(t *testing.T) {
+	add := func(n int) Actor {
+		return ActorFn(func(ctx context.Context, in interface{}) (out interface{}, err error) {
+			return in.(int) + n, nil
+		})
+	}
+
+	// the join node tells its inputs apart by the ports
+	var left, right int32
+	join := ActorFn(func(ctx context.Context, in interface{}) (out interface{}, err error) {
+		m := in.(PortMessage)
+		switch m.Port {
+		case "left":
+			atomic.AddInt32(&left, 1)
+		case "right":
+			atomic.AddInt32(&right, 1)
+		}
+		return m.Data, nil
+	})
+
+	// odd numbers go to a side branch
+	split := ActorFn(func(ctx context.Context, in interface{}) (out interface{}, err error) {
+		if in.(int)%2 == 1 {
+			return PortMessage{Port: "odd", Data: in}, nil
+		}
+		return in, nil
+	})
+
+	d, err := NewGraph().
+		AddNode("split", split).
+		AddNode("a", add(100)).
+		AddNode("b", add(200)).
+		AddNode("join", join).
+		Connect(GraphInput, "split").
+		Connect("split", "a").
+		Connect("split", "b").
+		Connect("a", "join.left").
+		Connect("b", "join.right").
+		Connect("join", GraphOutput).
+		Connect("split.odd", "output.odd").
+		Run(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go func() {
+		for i := 0; i < 4; i++ {
+			d.In() <- i
+		}
+		close(d.In())
+	}()
+
+	var sum, odd int
+	for out := range d.Out() {
+		if m, ok := out.(PortMessage); ok {
+			if m.Port != "odd" {
+				t.Fatalf("expected: %s actual: %s", "odd", m.Port)
+			}
+			odd += m.Data.(int)
+			continue
+		}
+		sum += out.(int)
+	}
+
+	// 0 and 2 pass both branches
+	if sum != 2*(0+2)+2*100+2*200 {
+		t.Fatalf("expected: %d actual: %d", 2*(0+2)+2*100+2*200, sum)
+	}
+	if odd != 1+3 {
+		t.Fatalf("expected: %d actual: %d", 1+3, odd)
+	}
+	if left != 2 || right != 2 {
+		t.Fatalf("expected: 2 and 2 actual: %d and %d", left, right)
+	}
+	if err := d.WaitErr(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestGraphErrors(t *testing.T) {
+	pass := ActorFn(func(ctx context.Context, in interface{}) (out interface{}, err error) {
+		return in, nil
+	})
+
+	_, err := NewGraph().
+		AddNode("a", pass).
+		AddNode("b", pass).
+		Connect("a", "b").
+		Connect("b", "a").
+		Run(context.Background())
+	if !errors.Is(err, ErrorGraphCycle) {
+		t.Fatalf("expected: %v actual: %v", ErrorGraphCycle, err)
+	}
+
+	_, err = NewGraph().
+		AddNode("a", pass).
+		AddNode("a", pass).
+		AddNode("b", 42).
+		Connect("a", "c").
+		Run(context.Background())
+	if !errors.Is(err, ErrorGraphNode) || !errors.Is(err, ErrorGraphEdge) {
+		t.Fatalf("expected: %v and %v actual: %v", ErrorGraphNode, ErrorGraphEdge, err)
+	}
+}
+
+func TestGraphStop(t *testing.T) {
+	generator := NewDaemon(func(ctx context.Context, in chan interface{}, out chan interface{}, err chan error) error {
+		for i := 0; ; i++ {
+			if !emit(ctx, out, i) {
+				return nil
+			}
+		}
+	})
+
+	d, err := NewGraph().
+		AddNode("gen", generator).
+		Connect("gen", GraphOutput).
+		Run(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	<-d.Out()
+	d.Stop()
+	d.Wait()
+
+	for range d.Out() {
+	}
+	if d.Status() != StatusStopped {
+		t.Fatalf("expected: %s actual: %s", StatusStopped, d.Status())
+	}
+}
+
+func TestDescribe(t *testing.T) {
+	pass := ActorFn(func(ctx context.Context, in interface{}) (out interface{}, err error) {
+		return in, nil
+	})
+
+	pipeline := pass.AsDaemon(WithName("parse"), WithBuffer(4)).
+		ConnectDaemon(NewDaemonsCluster(3, pass.AsDaemon(WithName("work")), WithName("workers"), WithInBuffer(8))).
+		ConnectDaemon(pass.AsDaemon(WithName("store")))
+
+	topology := Describe(pipeline)
+
+	root := topology.Root
+	if root.Kind != KindConnector || len(root.Children) != 2 {
+		t.Fatalf("expected connector with 2 children actual: %s with %d", root.Kind, len(root.Children))
+	}
+
+	parse := root.Children[0].Children[0]
+	if parse.Name != "parse" || parse.InCap != 4 || parse.OutCap != 4 {
+		t.Fatalf("unexpected stage: %+v", parse)
+	}
+
+	cluster := root.Children[0].Children[1]
+	if cluster.Kind != KindCluster || cluster.Name != "workers" || cluster.Workers != 3 || cluster.InCap != 8 {
+		t.Fatalf("unexpected cluster: %+v", cluster)
+	}
+	if len(cluster.Children) != 1 || cluster.Children[0].Name != "work" {
+		t.Fatalf("unexpected cluster worker: %+v", cluster.Children)
+	}
+
+	// parse -> work -> store
+	store := root.Children[1]
+	expected := []TopologyEdge{
+		{From: parse.ID, To: cluster.Children[0].ID},
+		{From: cluster.Children[0].ID, To: store.ID},
+	}
+	if fmt.Sprint(topology.Edges) != fmt.Sprint(expected) {
+		t.Fatalf("expected: %v actual: %v", expected, topology.Edges)
+	}
+
+	dot := topology.DOT()
+	for _, s := range []string{"digraph pipeline {", "subgraph cluster_", `label="workers\nworkers: 3\nin: 8 out: 0"`, parse.ID + " -> " + cluster.Children[0].ID} {
+		if !strings.Contains(dot, s) {
+			t.Fatalf("expected %q in:\n%s", s, dot)
+		}
+	}
+
+	mermaid := topology.Mermaid()
+	for _, s := range []string{"flowchart LR", "subgraph " + cluster.ID, `"parse<br/>in: 4 out: 4"`, cluster.Children[0].ID + " --> " + store.ID} {
+		if !strings.Contains(mermaid, s) {
+			t.Fatalf("expected %q in:\n%s", s, mermaid)
+		}
+	}
+}
+
+func TestDescribeStages(t *testing.T) {
+	pass := ActorFn(func(ctx context.Context, in interface{}) (out interface{}, err error) {
+		return in, nil
+	})
+	key := func(in interface{}) string {
+		return fmt.Sprint(in)
+	}
+
+	var factoryCalls int
+	factory := func(id int) Daemon {
+		factoryCalls++
+		return pass.AsDaemon()
+	}
+
+	clusters := map[string]Daemon{
+		"partitioned": NewPartitionedCluster(3, key, pass.AsDaemon(WithName("work")), WithName("partitioned")),
+		"ordered":     NewOrderedDaemonsCluster(3, 0, pass.AsDaemon(WithName("work")), WithName("ordered")),
+		"factory":     NewDaemonsClusterWithFactory(3, factory, WithName("factory")),
+	}
+	_, clusters["broadcast"] = NewDaemonsClusterWithBroadcast(3, pass.AsDaemon(WithName("work")), WithName("broadcast"))
+
+	for name, cluster := range clusters {
+		root := Describe(cluster).Root
+		if root.Kind != KindCluster || root.Name != name || root.Workers != 3 || len(root.Children) != 1 {
+			t.Fatalf("unexpected cluster: %+v", root)
+		}
+		if name != "factory" && root.Children[0].Name != "work" {
+			t.Fatalf("unexpected %s worker: %+v", name, root.Children[0])
+		}
+	}
+	// describing has no side effects
+	if factoryCalls != 0 {
+		t.Fatalf("expected no factory calls actual: %d", factoryCalls)
+	}
+
+	router := NewRouter(RouteFirst(), map[string]Daemon{
+		"a":           pass.AsDaemon(WithName("a")),
+		DefaultBranch: pass.AsDaemon(WithName("b")),
+	}, WithName("route"))
+	topology := Describe(NewSupervisor([]Daemon{NewMergeDaemon(pass.AsDaemon()), router}))
+
+	root := topology.Root
+	if root.Kind != KindSupervisor || len(root.Children) != 2 {
+		t.Fatalf("unexpected supervisor: %+v", root)
+	}
+	merge, route := root.Children[0], root.Children[1]
+	if merge.Kind != KindMerge || len(merge.Children) != 2 || route.Kind != KindRouter || len(route.Children) != 3 {
+		t.Fatalf("unexpected stages: %+v %+v", merge, route)
+	}
+
+	// upstream -> merge -> router -> branches
+	var labels []string
+	for _, e := range topology.Edges {
+		labels = append(labels, e.From+" -> "+e.To+" "+e.Label)
+	}
+	expected := []string{
+		merge.Children[1].ID + " -> " + merge.Children[0].ID + " ",
+		route.Children[0].ID + " -> " + route.Children[1].ID + " a",
+		route.Children[0].ID + " -> " + route.Children[2].ID + " default",
+		merge.Children[0].ID + " -> " + route.Children[0].ID + " ",
+	}
+	if fmt.Sprint(labels) != fmt.Sprint(expected) {
+		t.Fatalf("expected: %v actual: %v", expected, labels)
+	}
+}
+
+func TestDescribeGraph(t *testing.T) {
+	pass := ActorFn(func(ctx context.Context, in interface{}) (out interface{}, err error) {
+		return in, nil
+	})
+
+	topology := Describe(NewGraph(WithName("diamond")).
+		AddNode("split", pass).
+		AddNode("a", pass).
+		AddNode("b", pass).
+		AddNode("join", pass).
+		Connect(GraphInput, "split").
+		Connect("split", "a").
+		Connect("split.odd", "b").
+		Connect("a", "join").
+		Connect("b", "join.right").
+		Connect("join", GraphOutput).
+		AsDaemon())
+
+	if topology.Root.Kind != KindGraph || topology.Root.Name != "diamond" || len(topology.Root.Children) != 4 {
+		t.Fatalf("unexpected graph: %+v", topology.Root)
+	}
+
+	var labels []string
+	for _, e := range topology.Edges {
+		labels = append(labels, e.Label)
+	}
+	if fmt.Sprint(labels) != fmt.Sprint([]string{"", "odd", "", "right"}) {
+		t.Fatalf("unexpected edges: %v", topology.Edges)
+	}
+
+	if !strings.Contains(topology.Mermaid(), `-->|"odd"|`) {
+		t.Fatalf("expected labeled edge in:\n%s", topology.Mermaid())
+	}
+}
+
+func TestEnvelope(t *testing.T) {
+	double := ActorFn(func(ctx context.Context, in interface{}) (out interface{}, err error) {
+		EnvelopeFromContext(ctx).SetHeader("double", "done")
+		return in.(int) * 2, nil
+	})
+	split := ActorFn(func(ctx context.Context, in interface{}) (out interface{}, err error) {
+		return Outputs{in, in.(int) + 1}, nil
+	})
+
+	d, err := double.AsDaemon().
+		ConnectDaemon(NewDaemonsCluster(2, split.AsDaemon())).
+		Run(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	in := NewEnvelope(21)
+	in.SetHeader("source", "test")
+	d.In() <- in
+	close(d.In())
+
+	var payloads []interface{}
+	for out := range d.Out() {
+		e, ok := out.(*Envelope)
+		if !ok {
+			t.Fatalf("expected envelope actual: %T", out)
+		}
+		if e.ID != in.ID || e.Header("source") != "test" || e.Header("double") != "done" {
+			t.Fatalf("unexpected envelope: %+v", e)
+		}
+		payloads = append(payloads, e.Payload)
+	}
+	if fmt.Sprint(payloads) != "[42 43]" {
+		t.Fatalf("expected: [42 43] actual: %v", payloads)
+	}
+
+	// the stages change their own copy of the envelope
+	if in.Header("double") != "" {
+		t.Fatalf("input envelope changed: %+v", in)
+	}
+}
+
+func TestEnvelopeCall(t *testing.T) {
+	inc := ActorFn(func(ctx context.Context, in interface{}) (out interface{}, err error) {
+		return in.(int) + 1, nil
+	})
+
+	out, err := inc.ConnectActor(inc).Call(context.Background(), NewEnvelope(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e, ok := out.(*Envelope); !ok || e.Payload != 3 {
+		t.Fatalf("expected envelope of 3 actual: %v", out)
+	}
+
+	// plain messages stay plain
+	if out, _ := inc.Call(context.Background(), 1); out != 2 {
+		t.Fatalf("expected: 2 actual: %v", out)
+	}
+}
+
+func TestTypedEnvelope(t *testing.T) {
+	ctx := context.Background()
+
+	intPlusOne := NewTypedActor(func(ctx context.Context, in int) (int, error) {
+		return in + 1, nil
+	})
+	intToString := NewTypedDaemon(func(ctx context.Context, in chan int, out chan string, err chan error) error {
+		for inData := range in {
+			out <- fmt.Sprint(inData)
+		}
+		return nil
+	})
+
+	d, err := ConnectTypedDaemons(intPlusOne.AsTypedDaemon(), intToString).RunTyped(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	in := NewEnvelope(41)
+	d.In() <- in
+	out := <-d.Out()
+	if e, ok := out.(*Envelope); !ok || e.ID != in.ID || e.Payload != "42" {
+		t.Fatalf("expected envelope of 42 actual: %v", out)
+	}
+
+	// Receive returns the payload of an enveloped output
+	plusOne, err := intPlusOne.AsTypedDaemon().RunTyped(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	plusOne.In() <- NewEnvelope(1)
+	if out, err := plusOne.Receive(ctx); err != nil || out != 2 {
+		t.Fatalf("expected: 2 actual: %v %v", out, err)
+	}
+
+	d.Stop()
+	d.Wait()
+	plusOne.Stop()
+	plusOne.Wait()
+}
+
+func TestMetricsRegistry(t *testing.T) {
+	registry := NewMetricsRegistry()
+
+	parse := ActorFn(func(ctx context.Context, in interface{}) (out interface{}, err error) {
+		if in.(int) < 0 {
+			return nil, fmt.Errorf("negative")
+		}
+		return in, nil
+	})
+
+	d, err := parse.AsDaemon(WithName("parse"), WithInBuffer(4), WithErrorPolicy(ErrorPolicyDrop)).
+		ConnectDaemon(NewDaemonsCluster(2, parse.AsDaemon(WithName("store")), WithName("stores"))).
+		Run(ContextWithMetrics(context.Background(), registry))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, i := range []int{1, -1, 2, 3} {
+		d.In() <- i
+	}
+	close(d.In())
+	for range d.Out() {
+	}
+
+	server := httptest.NewServer(registry)
+	defer server.Close()
+
+	resp, err := server.Client().Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	text := string(body)
+
+	if !strings.HasPrefix(resp.Header.Get("Content-Type"), "text/plain; version=0.0.4") {
+		t.Fatalf("unexpected content type: %s", resp.Header.Get("Content-Type"))
+	}
+
+	for _, s := range []string{
+		`actor_messages_received_total{stage="parse"} 4`,
+		`actor_messages_emitted_total{stage="parse"} 3`,
+		`actor_messages_processed_total{stage="parse"} 3`,
+		`actor_messages_failed_total{stage="parse"} 1`,
+		`actor_messages_received_total{stage="stores"} 3`,
+		`actor_call_duration_seconds_bucket{stage="parse",le="+Inf"} 4`,
+		`actor_call_duration_seconds_count{stage="parse"} 4`,
+		`actor_channel_capacity{stage="parse",channel="in"} 4`,
+		`actor_channel_capacity{stage="stores",channel="in"} 0`,
+		"# TYPE actor_call_duration_seconds histogram",
+	} {
+		if !strings.Contains(text, s) {
+			t.Fatalf("expected %q in:\n%s", s, text)
+		}
+	}
+
+	// the workers of the cluster are labelled with their IDs
+	var stored int
+	for _, id := range []string{"0", "1"} {
+		var n int
+		prefix := `actor_messages_processed_total{stage="store",worker="` + id + `"} `
+		for _, line := range strings.Split(text, "\n") {
+			if strings.HasPrefix(line, prefix) {
+				fmt.Sscan(strings.TrimPrefix(line, prefix), &n)
+			}
+		}
+		stored += n
+	}
+	if stored != 3 {
+		t.Fatalf("expected: %d actual: %d in:\n%s", 3, stored, text)
+	}
+}
+
+func TestMetricsDaemonFn(t *testing.T) {
+	registry := NewMetricsRegistry()
+
+	// a daemon without actor calls records its failure and the messages of the partitioned cluster
+	load := NewDaemon(func(ctx context.Context, in chan interface{}, out chan interface{}, errChan chan error) error {
+		for range in {
+		}
+		return fmt.Errorf("load failed")
+	}, WithName("load"), WithErrorPolicy(ErrorPolicyDrop))
+	pass := ActorFn(func(ctx context.Context, in interface{}) (out interface{}, err error) {
+		return in, nil
+	})
+
+	d, err := NewPartitionedCluster(2, func(in interface{}) string {
+		return fmt.Sprint(in)
+	}, pass.AsDaemon(), WithName("partitions")).
+		ConnectDaemon(load).
+		Run(ContextWithMetrics(context.Background(), registry))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 3; i++ {
+		d.In() <- i
+	}
+	close(d.In())
+	d.Wait()
+
+	b := &strings.Builder{}
+	if err := registry.WriteText(b); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, s := range []string{
+		`actor_messages_failed_total{stage="load"} 1`,
+		`actor_messages_received_total{stage="partitions"} 3`,
+	} {
+		if !strings.Contains(b.String(), s) {
+			t.Fatalf("expected %q in:\n%s", s, b.String())
+		}
+	}
+}
+
+func TestTracing(t *testing.T) {
+	exporter := NewInMemoryExporter()
+	buf := &bytes.Buffer{}
+	chrome := NewChromeTraceExporter(buf)
+
+	pass := ActorFn(func(ctx context.Context, in interface{}) (out interface{}, err error) {
+		return in, nil
+	})
+	both := SpanExporterFn(func(span Span) {
+		exporter.ExportSpan(span)
+		chrome.ExportSpan(span)
+	})
+
+	d, err := pass.AsDaemon(WithName("parse")).
+		ConnectDaemon(NewDaemonsCluster(2, pass.AsDaemon(WithName("work")))).
+		ConnectDaemon(pass.AsDaemon(WithName("store"))).
+		Run(ContextWithSpanExporter(context.Background(), both))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	in := NewEnvelope(1)
+	d.In() <- in
+	close(d.In())
+	out := (<-d.Out()).(*Envelope)
+	d.Wait()
+
+	spans := exporter.Spans()
+	if len(spans) != 5 {
+		t.Fatalf("expected 5 spans actual: %+v", spans)
+	}
+
+	// parse, parse -> work, work, work -> store, store
+	names := []string{"parse", "parse -> work", "work", "work -> store", "store"}
+	var parent string
+	for i, span := range spans {
+		if span.Name != names[i] || span.TraceID != out.TraceID || span.ParentID != parent {
+			t.Fatalf("unexpected span %d: %+v", i, span)
+		}
+		parent = span.SpanID
+	}
+	if spans[2].Worker < 0 || out.SpanID != spans[4].SpanID {
+		t.Fatalf("unexpected spans: %+v", spans)
+	}
+	if in.TraceID != "" {
+		t.Fatalf("input envelope changed: %+v", in)
+	}
+
+	if err := chrome.Close(); err != nil {
+		t.Fatal(err)
+	}
+	var trace struct {
+		TraceEvents []struct {
+			Name  string `json:"name"`
+			Phase string `json:"ph"`
+		} `json:"traceEvents"`
+	}
+	if err := json.Unmarshal(buf.Bytes(), &trace); err != nil {
+		t.Fatal(err)
+	}
+
+	var complete int
+	for _, e := range trace.TraceEvents {
+		if e.Phase == "X" {
+			complete++
+		}
+	}
+	if complete != 5 {
+		t.Fatalf("expected 5 complete events actual: %s", buf.String())
+	}
+}
+
+func TestLogger(t *testing.T) {
+	buf := &bytes.Buffer{}
+	logger := slog.New(slog.NewJSONHandler(buf, &slog.HandlerOptions{Level: slog.LevelDebug}))
+
+	work := ActorFn(func(ctx context.Context, in interface{}) (out interface{}, err error) {
+		if in == "fail" {
+			return nil, fmt.Errorf("failed")
+		}
+		Logger(ctx).Info("handled")
+		return in, nil
+	})
+
+	d, err := NewDaemonsCluster(1, work.AsDaemon(WithName("work"), WithErrorPolicy(ErrorPolicyDrop)), WithName("workers")).
+		Run(ContextWithLogger(context.Background(), logger))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	in := NewEnvelope("ok")
+	d.In() <- in
+	d.In() <- "fail"
+	close(d.In())
+	for range d.Out() {
+	}
+	d.Wait()
+
+	type record struct {
+		Level   string
+		Msg     string
+		Stage   string
+		Worker  *int
+		Message string
+	}
+	var records []record
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		var r record
+		if err := json.Unmarshal([]byte(line), &r); err != nil {
+			t.Fatal(err)
+		}
+		records = append(records, r)
+	}
+
+	find := func(msg string, stage string) record {
+		for _, r := range records {
+			if r.Msg == msg && r.Stage == stage {
+				return r
+			}
+		}
+		t.Fatalf("expected %q of %q in:\n%s", msg, stage, buf.String())
+		return record{}
+	}
+
+	if r := find("handled", "work"); r.Level != "INFO" || r.Worker == nil || *r.Worker != 0 || r.Message != in.ID {
+		t.Fatalf("unexpected record: %+v", r)
+	}
+	if r := find("stage error", "work"); r.Level != "WARN" {
+		t.Fatalf("unexpected record: %+v", r)
+	}
+	find("daemon running", "workers")
+	find("daemon stopped", "work")
+
+	// without a logger nothing is logged
+	Logger(context.Background()).Error("discarded")
+}
+
+func TestStats(t *testing.T) {
+	release := make(chan struct{})
+	parse := ActorFn(func(ctx context.Context, in interface{}) (out interface{}, err error) {
+		if in.(int) < 0 {
+			return nil, fmt.Errorf("negative")
+		}
+		return in, nil
+	})
+	slow := ActorFn(func(ctx context.Context, in interface{}) (out interface{}, err error) {
+		<-release
+		return in, nil
+	})
+
+	d, err := parse.AsDaemon(WithName("parse"), WithInBuffer(8), WithErrorPolicy(ErrorPolicyDrop)).
+		ConnectDaemon(NewBalancedDaemonsCluster(2, NewRoundRobinBalancer(), slow.AsDaemon(WithName("slow")), WithName("workers"))).
+		Run(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, i := range []int{1, -1, 2} {
+		d.In() <- i
+	}
+
+	// both workers are busy with a message
+	deadline := time.Now().Add(time.Second)
+	for d.Stats().InFlight != 2 {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected 2 calls in flight: %+v", d.Stats())
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	stats := d.Stats()
+	if stats.MessagesIn != 3 || stats.Errors != 1 || stats.LastError == nil || stats.InCap != 8 || stats.Uptime <= 0 {
+		t.Fatalf("unexpected stats: %+v", stats)
+	}
+	if len(stats.Stages) != 2 || stats.Stages[0].Name != "parse" || stats.Stages[1].Name != "workers" {
+		t.Fatalf("unexpected stages: %+v", stats.Stages)
+	}
+	if workers := stats.Stages[1].Workers; len(workers) != 2 || workers[0].Name != "slow" || workers[0].InFlight != 1 {
+		t.Fatalf("unexpected workers: %+v", workers)
+	}
+
+	close(release)
+	close(d.In())
+	for range d.Out() {
+	}
+	d.Wait()
+
+	stats = d.Stats()
+	if stats.MessagesOut != 2 || stats.InFlight != 0 || stats.Status != StatusStopped {
+		t.Fatalf("unexpected stats: %+v", stats)
+	}
+	if uptime := d.Stats().Uptime; uptime != stats.Uptime {
+		t.Fatalf("expected stopped uptime: %s actual: %s", stats.Uptime, uptime)
+	}
+}
+
+func TestPartitionedAndOrderedClusterStats(t *testing.T) {
+	double := ActorFn(func(ctx context.Context, in interface{}) (out interface{}, err error) {
+		return in.(int) * 2, nil
+	})
+	key := KeyFn(func(in interface{}) string {
+		return fmt.Sprint(in)
+	})
+
+	clusters := map[string]Daemon{
+		"partitioned": NewPartitionedCluster(3, key, double.AsDaemon(WithName("double"))),
+		"ordered":     NewOrderedDaemonsCluster(3, 0, double.AsDaemon(WithName("double"))),
+	}
+	for name, c := range clusters {
+		d, err := c.Run(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for i := 0; i < 5; i++ {
+			d.In() <- i
+			<-d.Out()
+		}
+
+		// the workers are started while the first ones take messages
+		deadline := time.Now().Add(time.Second)
+		for len(d.Stats().Workers) != 3 {
+			if time.Now().After(deadline) {
+				t.Fatalf("%s: unexpected workers: %+v", name, d.Stats().Workers)
+			}
+			time.Sleep(time.Millisecond)
+		}
+
+		stats := d.Stats()
+		if stats.MessagesIn != 5 || stats.MessagesOut != 5 || stats.Workers[0].Name != "double" {
+			t.Fatalf("%s: unexpected stats: %+v", name, stats)
+		}
+
+		close(d.In())
+		d.Wait()
+	}
+
+	// an unnamed cluster is named after its constructor, not after the DaemonFn of its workers
+	unnamed := []struct {
+		name    string
+		cluster Daemon
+	}{
+		{funcName(NewPartitionedCluster), NewPartitionedCluster(1, key, double.AsDaemon())},
+		{funcName(NewOrderedDaemonsCluster), NewOrderedDaemonsCluster(1, 0, double.AsDaemon())},
+		{funcName(NewDaemonsCluster), NewBalancedDaemonsCluster(1, NewRoundRobinBalancer(), double.AsDaemon())},
+	}
+	for _, u := range unnamed {
+		d, err := u.cluster.Run(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if name := d.Stats().Name; name != u.name {
+			t.Fatalf("expected: %s actual: %s", u.name, name)
+		}
+		d.Stop()
+		d.Wait()
+	}
+}
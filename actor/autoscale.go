@@ -0,0 +1,55 @@
+package actor
+
+import "time"
+
+// Autoscale resizes a running cluster between min and max workers until it stops.
+// Every interval it adds a worker when messages wait in the input or every worker
+// is busy, and retires one when the input is empty and less than half of the
+// workers are busy.
+func Autoscale(cluster DaemonsCluster, min, max int, interval time.Duration) error {
+	if min < 1 || max < min {
+		return ErrorClusterSize
+	}
+	if !cluster.IsLaunched() {
+		return ErrorNotLaunched
+	}
+
+	done := make(chan struct{})
+	go func() {
+		cluster.Wait()
+		close(done)
+	}()
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+			}
+
+			load := cluster.Load()
+			size := load.Size
+
+			switch {
+			case size < min:
+				size = min
+			case size > max:
+				size = max
+			case size < max && (load.Queued > 0 || load.Busy >= load.Size):
+				size++
+			case size > min && load.Queued == 0 && load.Busy*2 < load.Size:
+				size--
+			}
+
+			if size != load.Size && cluster.Resize(size) != nil {
+				return
+			}
+		}
+	}()
+
+	return nil
+}
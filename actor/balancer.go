@@ -0,0 +1,71 @@
+package actor
+
+import (
+	"math/rand"
+	"sync/atomic"
+)
+
+// Balancer picks the worker of a balanced cluster for every message
+type Balancer interface {
+	// Pick returns the index of the worker for the next message.
+	// inFlight has the number of messages every worker processes or has waiting.
+	Pick(inFlight []int) int
+}
+
+type BalancerFn func(inFlight []int) int
+
+func (fn BalancerFn) Pick(inFlight []int) int {
+	return fn(inFlight)
+}
+
+// stealingBalancer makes the workers take messages from the other queues
+// when their own queue is empty
+type stealingBalancer interface {
+	Balancer
+	steal()
+}
+
+// BalancerLeastOutstanding picks the worker with the fewest messages in flight
+var BalancerLeastOutstanding = BalancerFn(func(inFlight []int) int {
+	var least int
+	for i, n := range inFlight {
+		if n < inFlight[least] {
+			least = i
+		}
+	}
+	return least
+})
+
+// BalancerPowerOfTwo picks two random workers and takes the less loaded one
+var BalancerPowerOfTwo = BalancerFn(func(inFlight []int) int {
+	a, b := rand.Intn(len(inFlight)), rand.Intn(len(inFlight))
+	if inFlight[b] < inFlight[a] {
+		return b
+	}
+	return a
+})
+
+type roundRobinBalancer struct {
+	next uint64
+}
+
+// NewRoundRobinBalancer returns a balancer that picks the workers in turn
+func NewRoundRobinBalancer() Balancer {
+	return &roundRobinBalancer{}
+}
+
+func (b *roundRobinBalancer) Pick(inFlight []int) int {
+	return int((atomic.AddUint64(&b.next, 1) - 1) % uint64(len(inFlight)))
+}
+
+type workStealingBalancer struct {
+	roundRobinBalancer
+}
+
+// NewWorkStealingBalancer returns a balancer that spreads the messages in turn,
+// idle workers take the messages queued for the busy ones.
+func NewWorkStealingBalancer() Balancer {
+	return &workStealingBalancer{}
+}
+
+func (b *workStealingBalancer) steal() {}
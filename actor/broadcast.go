@@ -0,0 +1,239 @@
+package actor
+
+import (
+	"context"
+	"fmt"
+	"sync"
+)
+
+var ErrorSlowSubscriber = fmt.Errorf("slow subscriber disconnected")
+
+// SlowSubscriberPolicy decides what the broadcast does with a message
+// when the buffer of a subscriber is full
+type SlowSubscriberPolicy int
+
+const (
+	// SlowSubscriberBlock waits for the subscriber, the other subscribers wait too
+	SlowSubscriberBlock SlowSubscriberPolicy = iota
+	// SlowSubscriberDropNewest drops the message
+	SlowSubscriberDropNewest
+	// SlowSubscriberDropOldest drops the oldest buffered message to make room for the new one
+	SlowSubscriberDropOldest
+	// SlowSubscriberDisconnect stops sending to the subscriber and closes its input
+	// after the buffered messages. ErrorSlowSubscriber is reported.
+	SlowSubscriberDisconnect
+)
+
+type broadcastSubscriber struct {
+	Daemon
+
+	buffer int
+	policy SlowSubscriberPolicy
+}
+
+// NewBroadcastSubscriber sets the buffer and the slow subscriber policy of a
+// NewBroadcastDaemon subscriber. Other subscribers are unbuffered and blocking.
+// The buffer of a non-blocking subscriber holds at least one message.
+func NewBroadcastSubscriber(daemon Daemon, buffer int, policy SlowSubscriberPolicy) Daemon {
+	if policy != SlowSubscriberBlock && buffer < 1 {
+		buffer = 1
+	}
+
+	return &broadcastSubscriber{
+		Daemon: daemon,
+		buffer: buffer,
+		policy: policy,
+	}
+}
+
+func (s *broadcastSubscriber) Clone() Daemon {
+	return &broadcastSubscriber{
+		Daemon: s.Daemon.Clone(),
+		buffer: s.buffer,
+		policy: s.policy,
+	}
+}
+
+func (s *broadcastSubscriber) closeIn() {
+	closeDaemonIn(s.Daemon)
+}
+
+func (s *broadcastSubscriber) closeOut() {
+	closeDaemonOut(s.Daemon)
+}
+
+func (s *broadcastSubscriber) describe(t *topologyBuilder) *describedNode {
+	return t.describe(s.Daemon)
+}
+
+// Subscriber of a running broadcast
+type broadcastTarget struct {
+	daemon  Daemon
+	policy  SlowSubscriberPolicy
+	queue   chan interface{}
+	started bool
+	closed  bool
+}
+
+// NewBroadcastDaemon copies every input message to the input of every subscriber.
+// Not launched subscribers are started with the broadcast, the subscribers keep
+// their own outputs. Every subscriber has its own buffer (see NewBroadcastSubscriber),
+// so a subscriber with a non-blocking policy doesn't stall the others.
+// When the broadcast input is closed, the subscribers inputs are closed too.
+func NewBroadcastDaemon(subscribers ...Daemon) Daemon {
+	return newBroadcastDaemon(subscribers, true)
+}
+
+// NewBroadcastDaemonWithOptions works like NewBroadcastDaemon with the options of the broadcast daemon
+func NewBroadcastDaemonWithOptions(subscribers []Daemon, opts ...DaemonOption) Daemon {
+	return newBroadcastDaemon(subscribers, true, opts...)
+}
+
+// newBroadcastDaemon doesn't start the subscribers when run is false,
+// they are run by somebody else.
+func newBroadcastDaemon(subscribers []Daemon, run bool, opts ...DaemonOption) Daemon {
+	fn := DaemonFn(func(ctx context.Context, in chan interface{}, out chan interface{}, errChan chan error) error {
+		targets := make([]*broadcastTarget, 0, len(subscribers))
+		stopTargets := func() {
+			for _, t := range targets {
+				if t.started {
+					t.daemon.Stop()
+					t.daemon.Wait()
+				}
+			}
+		}
+
+		for _, d := range subscribers {
+			t := &broadcastTarget{policy: SlowSubscriberBlock}
+
+			var buffer int
+			if s, ok := d.(*broadcastSubscriber); ok {
+				d, buffer, t.policy = s.Daemon, s.buffer, s.policy
+			}
+
+			if run && !d.IsLaunched() {
+				// the subscriber passed by the caller isn't changed
+				d = d.Clone()
+				if d.Err() == nil {
+					d.SetErr(errChan)
+				}
+
+				running, err := d.Run(ctx)
+				if err != nil {
+					stopTargets()
+					return err
+				}
+				d, t.started = running, true
+			}
+
+			t.daemon = d
+			t.queue = make(chan interface{}, buffer)
+			targets = append(targets, t)
+		}
+
+		wg := &sync.WaitGroup{}
+		for _, t := range targets {
+			wg.Add(1)
+			go func(t *broadcastTarget) {
+				defer wg.Done()
+				t.pump(ctx)
+			}(t)
+		}
+
+	broadcast:
+		for {
+			select {
+			case <-ctx.Done():
+				break broadcast
+
+			case inData, ok := <-in:
+				if !ok {
+					break broadcast
+				}
+
+				for _, t := range targets {
+					if !t.deliver(ctx, errChan, inData) {
+						break broadcast
+					}
+				}
+			}
+		}
+
+		for _, t := range targets {
+			t.close()
+		}
+		wg.Wait()
+
+		var errs []error
+		for _, t := range targets {
+			if t.started {
+				errs = append(errs, t.daemon.WaitErr())
+			}
+		}
+		return childErrors(errs...)
+	})
+
+	return NewDaemon(fn, opts...).(*daemonPrototype).withTopology(func(t *topologyBuilder, d *daemonPrototype) *describedNode {
+		return t.describeBroadcast(d, subscribers)
+	})
+}
+
+// deliver puts the message to the subscriber buffer. Returns false when the broadcast has to stop.
+func (t *broadcastTarget) deliver(ctx context.Context, errChan chan error, inData interface{}) bool {
+	if t.closed {
+		return true
+	}
+
+	if t.policy == SlowSubscriberBlock {
+		select {
+		case <-ctx.Done():
+			return false
+		case t.queue <- inData:
+			return true
+		}
+	}
+
+	for {
+		select {
+		case t.queue <- inData:
+			return true
+		default:
+		}
+
+		switch t.policy {
+		case SlowSubscriberDropNewest:
+			return true
+
+		case SlowSubscriberDropOldest:
+			select {
+			case <-t.queue:
+			default:
+			}
+
+		case SlowSubscriberDisconnect:
+			t.close()
+			err := newStageError(StageName(ctx), inData, fmt.Errorf("%w: %s", ErrorSlowSubscriber, stageLabel(t.daemon)))
+			return reportError(ctx, errChan, err) == nil
+		}
+	}
+}
+
+// pump passes the buffered messages to the subscriber and closes its input when the buffer is closed
+func (t *broadcastTarget) pump(ctx context.Context) {
+	defer closeDaemonIn(t.daemon)
+
+	for inData := range t.queue {
+		select {
+		case <-ctx.Done():
+			return
+		case t.daemon.In() <- inData:
+		}
+	}
+}
+
+func (t *broadcastTarget) close() {
+	if !t.closed {
+		t.closed = true
+		close(t.queue)
+	}
+}
@@ -0,0 +1,265 @@
+package actor
+
+import (
+	"context"
+	"strings"
+	"sync"
+)
+
+// Bus delivers messages published to a topic to the subscriptions with matching patterns.
+// Topics are dot separated, e.g. orders.42.created. In a pattern * matches one segment
+// and # matches any number of segments: orders.*.created, orders.#.
+type Bus interface {
+	// Publish sends msg to every matching subscription. It waits for the
+	// subscriptions with full inputs, use WithInBuffer to buffer them.
+	Publish(ctx context.Context, topic string, msg interface{}) error
+	// Subscribe returns a daemon that emits the messages of the topics matching pattern.
+	// The subscription starts when the daemon is run and ends when it stops.
+	Subscribe(pattern string, opts ...DaemonOption) Daemon
+	// Unsubscribe ends the running subscription after the messages it already has
+	Unsubscribe(subscription Daemon)
+	// Publisher returns a daemon that publishes its input to topic,
+	// connect a daemon to it to publish the daemon output.
+	Publisher(topic string, opts ...DaemonOption) Daemon
+	// PublisherFn works like Publisher, topicFn returns the topic of every message
+	PublisherFn(topicFn TopicFn, opts ...DaemonOption) Daemon
+}
+
+// TopicFn returns the topic of a message, the payload of an enveloped one
+type TopicFn func(msg interface{}) string
+
+type busInstance struct {
+	mu            sync.RWMutex
+	subscriptions map[chan interface{}]*busSubscription
+}
+
+type busSubscription struct {
+	pattern []string
+	in      chan interface{}
+	// closed by Unsubscribe and when the subscription stops, releases the publishers
+	done chan struct{}
+
+	mu     sync.RWMutex
+	closed bool
+}
+
+func NewBus() Bus {
+	return &busInstance{
+		subscriptions: make(map[chan interface{}]*busSubscription),
+	}
+}
+
+func (b *busInstance) Publish(ctx context.Context, topic string, msg interface{}) error {
+	segments := strings.Split(topic, ".")
+
+	b.mu.RLock()
+	matched := make([]*busSubscription, 0, len(b.subscriptions))
+	for _, s := range b.subscriptions {
+		if matchTopic(s.pattern, segments) {
+			matched = append(matched, s)
+		}
+	}
+	b.mu.RUnlock()
+
+	for _, s := range matched {
+		if err := s.send(ctx, msg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (b *busInstance) Subscribe(pattern string, opts ...DaemonOption) Daemon {
+	return &busSubscriptionDaemon{
+		Daemon: NewDaemon(func(ctx context.Context, in chan interface{}, out chan interface{}, errChan chan error) error {
+			defer b.remove(in)
+
+			for {
+				select {
+				case <-ctx.Done():
+					return nil
+
+				case msg, ok := <-in:
+					if !ok {
+						return nil
+					}
+					if !emit(ctx, out, msg) {
+						return nil
+					}
+				}
+			}
+		}, opts...),
+		bus:     b,
+		pattern: pattern,
+	}
+}
+
+// add subscribes in to the topics matching pattern
+func (b *busInstance) add(pattern string, in chan interface{}) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.subscriptions[in] = &busSubscription{
+		pattern: strings.Split(pattern, "."),
+		in:      in,
+		done:    make(chan struct{}),
+	}
+}
+
+func (b *busInstance) Unsubscribe(subscription Daemon) {
+	if b.remove(subscription.In()) {
+		closeDaemonIn(subscription)
+	}
+}
+
+// remove removes the subscription reading in and waits for the running publishes to it.
+// Returns false when there is no such subscription.
+func (b *busInstance) remove(in chan interface{}) bool {
+	b.mu.Lock()
+	s, ok := b.subscriptions[in]
+	delete(b.subscriptions, in)
+	b.mu.Unlock()
+
+	if !ok {
+		return false
+	}
+
+	close(s.done)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.closed = true
+	return true
+}
+
+func (b *busInstance) Publisher(topic string, opts ...DaemonOption) Daemon {
+	return b.PublisherFn(func(interface{}) string {
+		return topic
+	}, opts...)
+}
+
+func (b *busInstance) PublisherFn(topicFn TopicFn, opts ...DaemonOption) Daemon {
+	return NewDaemon(func(ctx context.Context, in chan interface{}, out chan interface{}, errChan chan error) error {
+		for {
+			select {
+			case <-ctx.Done():
+				return nil
+
+			case msg, ok := <-in:
+				if !ok {
+					return nil
+				}
+				if err := b.Publish(ctx, topicFn(Payload(msg)), msg); err != nil {
+					return nil
+				}
+			}
+		}
+	}, opts...)
+}
+
+// busSubscriptionDaemon subscribes the daemon input before the daemon starts,
+// so no message published after Run is missed
+type busSubscriptionDaemon struct {
+	Daemon
+
+	bus     *busInstance
+	pattern string
+}
+
+func (d *busSubscriptionDaemon) Run(ctx context.Context) (Daemon, error) {
+	if d.IsLaunched() {
+		return d, ErrorAlreadyLaunched
+	}
+
+	p := d.Daemon.Clone().(*daemonPrototype)
+	if p.In() == nil {
+		p.SetIn(make(chan interface{}, p.opts.inBuffer))
+	}
+
+	d.bus.add(d.pattern, p.In())
+
+	dl, err := p.Run(ctx)
+	if err != nil {
+		d.bus.remove(p.In())
+		return nil, err
+	}
+
+	return &busSubscriptionDaemon{Daemon: dl, bus: d.bus, pattern: d.pattern}, nil
+}
+
+func (d *busSubscriptionDaemon) Clone() Daemon {
+	if d.IsLaunched() {
+		return d
+	}
+	return &busSubscriptionDaemon{Daemon: d.Daemon.Clone(), bus: d.bus, pattern: d.pattern}
+}
+
+func (d *busSubscriptionDaemon) closeIn() {
+	closeDaemonIn(d.Daemon)
+}
+
+func (d *busSubscriptionDaemon) closeOut() {
+	closeDaemonOut(d.Daemon)
+}
+
+func (d *busSubscriptionDaemon) ConnectActor(actor Actor) Daemon {
+	return NewDaemonActorConnector(d, actor)
+}
+
+func (d *busSubscriptionDaemon) ConnectDaemon(daemon Daemon) Daemon {
+	return NewDaemonsConnector(d, daemon)
+}
+
+func (d *busSubscriptionDaemon) AsDaemon() Daemon {
+	return d
+}
+
+func (d *busSubscriptionDaemon) describe(t *topologyBuilder) *describedNode {
+	return t.describe(d.Daemon)
+}
+
+func (s *busSubscription) send(ctx context.Context, msg interface{}) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if s.closed {
+		return nil
+	}
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-s.done:
+		return nil
+	case s.in <- msg:
+		return nil
+	}
+}
+
+// matchTopic matches the topic segments against the pattern segments
+func matchTopic(pattern []string, topic []string) bool {
+	for i, p := range pattern {
+		switch p {
+		case "#":
+			for j := i; j <= len(topic); j++ {
+				if matchTopic(pattern[i+1:], topic[j:]) {
+					return true
+				}
+			}
+			return false
+
+		case "*":
+			if i >= len(topic) {
+				return false
+			}
+
+		default:
+			if i >= len(topic) || p != topic[i] {
+				return false
+			}
+		}
+	}
+
+	return len(pattern) == len(topic)
+}
@@ -0,0 +1,528 @@
+package actor
+
+import (
+	"context"
+	"reflect"
+	"sync"
+	"sync/atomic"
+)
+
+type clusterWorker struct {
+	daemon  Daemon
+	retire  chan struct{}
+	stopped chan struct{}
+	// messages of the balanced cluster, nil when the worker takes the shared input
+	queue       chan interface{}
+	queueClosed bool
+	// messages queued or being passed to the worker, the calls it runs are in its stats
+	inFlight int32
+
+	// closed when the feeder returns
+	fed chan struct{}
+	// message the feeder took when the worker stopped, it goes to the other workers
+	leftover    interface{}
+	hasLeftover bool
+}
+
+type clusterExit struct {
+	worker *clusterWorker
+	err    error
+}
+
+// clusterResize is a Resize call, done is closed when the workers are started or retired
+type clusterResize struct {
+	size int
+	done chan struct{}
+}
+
+// Workers of a running cluster. Every worker has its own input channel fed
+// from the cluster input or from its queue, so a single worker can be retired.
+type clusterWorkers struct {
+	factory  DaemonFactory
+	size     int
+	balancer Balancer
+	nextID   int
+
+	// stage name of the cluster in the metrics
+	stage string
+	out   chan interface{}
+
+	mu      sync.Mutex
+	workers []*clusterWorker
+	in      chan interface{}
+	// outputs and errors of the stopped workers
+	exited  Stats
+	resizes chan clusterResize
+	done    chan struct{}
+	// leftovers of the stopped workers for the feeders of the shared input
+	redeliver chan interface{}
+}
+
+func newClusterWorkers(factory DaemonFactory, size int, balancer Balancer) *clusterWorkers {
+	return &clusterWorkers{
+		factory:   factory,
+		size:      size,
+		balancer:  balancer,
+		resizes:   make(chan clusterResize),
+		done:      make(chan struct{}),
+		redeliver: make(chan interface{}),
+	}
+}
+
+func (c *clusterWorkers) run(ctx context.Context, in chan interface{}, out chan interface{}, errChan chan error) error {
+	defer close(c.done)
+
+	c.mu.Lock()
+	c.in = in
+	c.mu.Unlock()
+
+	stageFromContext(ctx).stats.setInner(c.addStats)
+
+	c.out = out
+	c.stage = StageName(ctx)
+	if c.stage == "" {
+		c.stage = funcName(c.run)
+	}
+
+	queueSize := cap(in)
+	if queueSize < 1 {
+		queueSize = 1
+	}
+
+	exits := make(chan clusterExit)
+	var running int
+	var errs []error
+
+	// the balanced cluster reads the input here, the shared one in the feeders
+	var input chan interface{}
+	if c.balancer != nil {
+		input = in
+	}
+
+	cluster := StageName(ctx)
+
+	start := func() error {
+		id := c.nextID
+		c.nextID++
+
+		d := c.factory(id).Clone()
+
+		d.DisableCloseChannelsOnStop(true)
+		d.SetIn(make(chan interface{}))
+		d.SetOut(out)
+		d.SetErr(errChan)
+
+		daemonInstance, err := d.Run(withWorker(ctx, cluster, id))
+		if err != nil {
+			return err
+		}
+
+		w := &clusterWorker{
+			daemon:  daemonInstance,
+			retire:  make(chan struct{}),
+			stopped: make(chan struct{}),
+			fed:     make(chan struct{}),
+		}
+		if c.balancer != nil {
+			w.queue = make(chan interface{}, queueSize)
+		}
+
+		c.mu.Lock()
+		c.workers = append(c.workers, w)
+		c.mu.Unlock()
+
+		running++
+		if w.queue != nil {
+			go c.feedQueue(ctx, w)
+		} else {
+			go c.feed(ctx, w, in)
+		}
+		go func() {
+			err := w.daemon.WaitErr()
+			close(w.stopped)
+			<-w.fed
+			exits <- clusterExit{worker: w, err: err}
+		}()
+
+		return nil
+	}
+
+	var dispatch, share func(inData interface{})
+
+	// lost reports a message no worker is left to take. The ordered cluster
+	// gets the reply of a sequenced message, so it doesn't wait for it.
+	lost := func(inData interface{}) {
+		if ctx.Err() != nil {
+			return
+		}
+
+		errs = append(errs, newStageError(cluster, inData, ErrorNoWorkers))
+		reportError(ctx, errChan, errs[len(errs)-1])
+		if s, ok := inData.(sequenced); ok {
+			select {
+			case <-ctx.Done():
+			case out <- sequenced{seq: s.seq, data: Drop}:
+			}
+		}
+	}
+
+	exit := func(e clusterExit) {
+		running--
+		c.remove(e.worker)
+		c.addExited(e.worker.daemon.Stats())
+		errs = append(errs, e.err)
+
+		// messages taken or queued for the stopped worker go to the others
+		if e.worker.hasLeftover {
+			if c.balancer != nil {
+				dispatch(e.worker.leftover)
+			} else {
+				share(e.worker.leftover)
+			}
+		}
+		if e.worker.queue != nil {
+			c.closeQueue(e.worker)
+			for inData := range e.worker.queue {
+				atomic.AddInt32(&e.worker.inFlight, -1)
+				dispatch(inData)
+			}
+		}
+	}
+
+	resize := func(r clusterResize) {
+		defer close(r.done)
+
+		// new workers wouldn't get any message
+		if ctx.Err() != nil || c.balancer != nil && input == nil {
+			return
+		}
+
+		c.retire(r.size)
+		for size := c.Load().Size; size < r.size; size++ {
+			if err := start(); err != nil {
+				errs = append(errs, newStageError(StageName(ctx), nil, err))
+				reportError(ctx, errChan, errs[len(errs)-1])
+				return
+			}
+		}
+
+		if logger := stageLogger(ctx); logger != nil {
+			logger.Info("cluster resized", "size", r.size)
+		}
+	}
+
+	dispatch = func(inData interface{}) {
+		for {
+			w := c.pick()
+			if w == nil {
+				lost(inData)
+				return
+			}
+
+			atomic.AddInt32(&w.inFlight, 1)
+			select {
+			case <-ctx.Done():
+				atomic.AddInt32(&w.inFlight, -1)
+				return
+			case w.queue <- inData:
+				return
+			case e := <-exits:
+				atomic.AddInt32(&w.inFlight, -1)
+				exit(e)
+			case r := <-c.resizes:
+				atomic.AddInt32(&w.inFlight, -1)
+				resize(r)
+			}
+		}
+	}
+
+	// share passes a message to the first feeder of the shared input that takes it
+	share = func(inData interface{}) {
+		for {
+			if c.Load().Size == 0 {
+				lost(inData)
+				return
+			}
+
+			select {
+			case <-ctx.Done():
+				return
+			case c.redeliver <- inData:
+				return
+			case e := <-exits:
+				exit(e)
+			case r := <-c.resizes:
+				resize(r)
+			}
+		}
+	}
+
+	for i := 0; i < c.size; i++ {
+		if err := start(); err != nil {
+			c.retire(0)
+			for ; running > 0; running-- {
+				<-exits
+			}
+			return err
+		}
+	}
+
+	ctxDone := ctx.Done()
+	for running > 0 {
+		select {
+		case <-ctxDone:
+			input, ctxDone = nil, nil
+
+		case e := <-exits:
+			exit(e)
+
+		case r := <-c.resizes:
+			resize(r)
+
+		case inData, ok := <-input:
+			if !ok {
+				// workers finish their queues and stop
+				input = nil
+				c.retire(0)
+				continue
+			}
+			dispatch(inData)
+		}
+	}
+
+	return childErrors(errs...)
+}
+
+// feed passes messages from the cluster input to the worker until the input
+// is closed or the worker is retired, then closes the worker input.
+func (c *clusterWorkers) feed(ctx context.Context, w *clusterWorker, in chan interface{}) {
+	defer close(w.fed)
+	defer closeDaemonIn(w.daemon)
+
+	for {
+		var inData interface{}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-w.retire:
+			return
+		case <-w.stopped:
+			return
+
+		case inData = <-c.redeliver:
+		case data, ok := <-in:
+			if !ok {
+				return
+			}
+			inData = data
+		}
+
+		atomic.AddInt32(&w.inFlight, 1)
+		ok := c.send(ctx, w, inData)
+		atomic.AddInt32(&w.inFlight, -1)
+		if !ok {
+			return
+		}
+	}
+}
+
+// feedQueue passes messages from the worker queue to the worker until the queue
+// is closed, then closes the worker input. A work-stealing worker takes messages
+// from the queues of the other workers when its own queue is empty.
+func (c *clusterWorkers) feedQueue(ctx context.Context, w *clusterWorker) {
+	defer close(w.fed)
+	defer closeDaemonIn(w.daemon)
+
+	_, steal := c.balancer.(stealingBalancer)
+
+	for {
+		inData, ok := c.next(ctx, w, steal)
+		if !ok {
+			return
+		}
+
+		ok = c.send(ctx, w, inData)
+		atomic.AddInt32(&w.inFlight, -1)
+		if !ok {
+			return
+		}
+	}
+}
+
+func (c *clusterWorkers) send(ctx context.Context, w *clusterWorker, inData interface{}) bool {
+	observeChannels(ctx, c.stage, c.in, c.out)
+
+	select {
+	case <-ctx.Done():
+		return false
+	case <-w.stopped:
+		// the worker has already failed or ended the stream,
+		// the cluster passes the message to another worker
+		w.leftover, w.hasLeftover = inData, true
+		return false
+	case w.daemon.In() <- inData:
+		stageFromContext(ctx).stats.received()
+		observeReceived(ctx)
+		return true
+	}
+}
+
+// next returns the next message of the worker. The message is counted in flight of w.
+func (c *clusterWorkers) next(ctx context.Context, w *clusterWorker, steal bool) (interface{}, bool) {
+	select {
+	case inData, ok := <-w.queue:
+		return inData, ok
+	default:
+	}
+
+	for {
+		cases := []reflect.SelectCase{
+			{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(ctx.Done())},
+			{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(w.stopped)},
+			{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(w.queue)},
+		}
+		owners := []*clusterWorker{nil, nil, w}
+
+		if steal {
+			c.mu.Lock()
+			for _, other := range c.workers {
+				if other != w {
+					cases = append(cases, reflect.SelectCase{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(other.queue)})
+					owners = append(owners, other)
+				}
+			}
+			c.mu.Unlock()
+		}
+
+		chosen, value, ok := reflect.Select(cases)
+		switch {
+		case chosen < 2:
+			return nil, false
+		case chosen == 2:
+			if !ok {
+				return nil, false
+			}
+			return value.Interface(), true
+		case !ok:
+			// the other worker is retired, its queue is closed
+			continue
+		}
+
+		atomic.AddInt32(&owners[chosen].inFlight, -1)
+		atomic.AddInt32(&w.inFlight, 1)
+		return value.Interface(), true
+	}
+}
+
+// pick returns the worker for the next message, nil when there are no workers
+func (c *clusterWorkers) pick() *clusterWorker {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if len(c.workers) == 0 {
+		return nil
+	}
+
+	i := c.balancer.Pick(c.inFlight())
+	if i < 0 || i >= len(c.workers) {
+		i = 0
+	}
+	return c.workers[i]
+}
+
+// retire retires the workers above size
+func (c *clusterWorkers) retire(size int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for len(c.workers) > size {
+		last := len(c.workers) - 1
+		w := c.workers[last]
+
+		close(w.retire)
+		if w.queue != nil && !w.queueClosed {
+			w.queueClosed = true
+			close(w.queue)
+		}
+		c.workers = c.workers[:last]
+	}
+}
+
+func (c *clusterWorkers) closeQueue(w *clusterWorker) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if !w.queueClosed {
+		w.queueClosed = true
+		close(w.queue)
+	}
+}
+
+func (c *clusterWorkers) remove(w *clusterWorker) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for i := range c.workers {
+		if c.workers[i] == w {
+			c.workers = append(c.workers[:i], c.workers[i+1:]...)
+			return
+		}
+	}
+}
+
+func (c *clusterWorkers) addExited(stats Stats) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.exited.MessagesOut += stats.MessagesOut
+	c.exited.Errors += stats.Errors
+	if stats.LastError != nil {
+		c.exited.LastError = stats.LastError
+	}
+}
+
+func (c *clusterWorkers) resize(n int) error {
+	r := clusterResize{size: n, done: make(chan struct{})}
+
+	select {
+	case <-c.done:
+		return ErrorStopped
+	case c.resizes <- r:
+		<-r.done
+		return nil
+	}
+}
+
+func (c *clusterWorkers) Load() ClusterLoad {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	load := ClusterLoad{
+		Size:   len(c.workers),
+		Queued: len(c.in),
+	}
+	for _, n := range c.inFlight() {
+		if n > 0 {
+			load.Busy++
+		}
+	}
+	return load
+}
+
+func (c *clusterWorkers) InFlight() []int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.inFlight()
+}
+
+// inFlight counts the messages every worker is processing or has waiting for it,
+// so a worker in the middle of a slow call isn't taken for an idle one
+func (c *clusterWorkers) inFlight() []int {
+	inFlight := make([]int, len(c.workers))
+	for i, w := range c.workers {
+		inFlight[i] = int(atomic.LoadInt32(&w.inFlight)) + w.daemon.Stats().InFlight
+	}
+	return inFlight
+}
@@ -43,3 +43,26 @@ func NewDaemonActorConnector(from Daemon, to Actor) DaemonsConnector {
 		to.AsActorFn().AsDaemon(),
 	)
 }
+
+// Daemons close the channels they own through these methods, so a channel
+// shared by two connected daemons is closed only once.
+type channelsCloser interface {
+	closeIn()
+	closeOut()
+}
+
+func closeDaemonIn(d Daemon) {
+	if c, ok := d.(channelsCloser); ok {
+		c.closeIn()
+	} else if in := d.In(); in != nil {
+		close(in)
+	}
+}
+
+func closeDaemonOut(d Daemon) {
+	if c, ok := d.(channelsCloser); ok {
+		c.closeOut()
+	} else if out := d.Out(); out != nil {
+		close(out)
+	}
+}
@@ -19,23 +19,20 @@ func (c *actorsConnectorInstance) ConnectDaemon(daemon Daemon) Daemon {
 func (c *actorsConnectorInstance) AsActorFn() ActorFn {
 	return func(ctx context.Context, in interface{}) (out interface{}, err error) {
 		fromOut, err := c.From().Call(ctx, in)
-		if err != nil {
+		if err != nil && !isEndOfStream(err) {
 			return nil, err
 		}
+		fromErr := err
 
-		if fromOut == nil {
-			return nil, nil
-		}
-
-		toOut, err := c.To().Call(ctx, fromOut)
+		toOut, err := callEach(ctx, c.To(), fromOut)
 		if err != nil {
-			return nil, err
+			return toOut, err
 		}
 
-		if toOut == nil {
-			return nil, nil
+		if IsDropped(toOut) {
+			return Drop, fromErr
 		}
-		return toOut, nil
+		return toOut, fromErr
 	}
 }
 
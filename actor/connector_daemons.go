@@ -2,7 +2,7 @@ package actor
 
 import (
 	"context"
-	"fmt"
+	"errors"
 )
 
 // Connection between two actors
@@ -10,11 +10,24 @@ type daemonsConnectorInstance struct {
 	errChan chan error
 	from    Daemon
 	to      Daemon
+	ctx     context.Context
+	cancel  context.CancelCauseFunc
 }
 
+// Close closes the connector input and output. The channel between the stages
+// belongs to the stages and is closed by them.
 func (d *daemonsConnectorInstance) Close() {
-	d.from.Close()
-	d.to.Close()
+	d.DisableCloseChannelsOnStop(true)
+	d.closeOut()
+	d.closeIn()
+}
+
+func (d *daemonsConnectorInstance) closeIn() {
+	closeDaemonIn(d.from)
+}
+
+func (d *daemonsConnectorInstance) closeOut() {
+	closeDaemonOut(d.to)
 }
 
 func (d *daemonsConnectorInstance) ConnectActor(actor Actor) Daemon {
@@ -30,8 +43,16 @@ func (d *daemonsConnectorInstance) DisableCloseChannelsOnStop(disabled bool) {
 	d.to.DisableCloseChannelsOnStop(disabled)
 }
 
+// Clone returns a not launched copy of the connector and its stages.
+// A running connector can't be copied, Clone returns the connector itself.
 func (d *daemonsConnectorInstance) Clone() Daemon {
+	if d.IsLaunched() {
+		return d
+	}
+
 	d2 := *d
+	d2.ctx = nil
+	d2.cancel = nil
 	d2.from = d2.from.Clone()
 	d2.to = d2.to.Clone()
 
@@ -39,7 +60,14 @@ func (d *daemonsConnectorInstance) Clone() Daemon {
 }
 
 func (d *daemonsConnectorInstance) Run(ctx context.Context) (Daemon, error) {
-	dl := d.Clone()
+	if d.IsLaunched() {
+		return d, ErrorAlreadyLaunched
+	}
+
+	dl := d.Clone().(*daemonsConnectorInstance)
+
+	ctx, dl.cancel = withPipeline(ctx)
+	dl.ctx = ctx
 	err := dl.AsDaemonFn()(ctx, dl.In(), dl.Out(), dl.Err())
 
 	return dl, err
@@ -48,35 +76,21 @@ func (d *daemonsConnectorInstance) Run(ctx context.Context) (Daemon, error) {
 func (d *daemonsConnectorInstance) AsDaemonFn() DaemonFn {
 	return func(ctx context.Context, in chan interface{}, out chan interface{}, errors chan error) error {
 		if d.IsLaunched() {
-			return fmt.Errorf("already launched")
+			return ErrorAlreadyLaunched
 		}
 
-		if d.from.In() == nil {
-			if in == nil {
-				in = make(chan interface{})
-			}
-			d.SetIn(in)
+		if in != nil && !d.from.IsLaunched() {
+			d.from.SetIn(in)
 		}
-
-		if d.to.Out() == nil {
-			if out == nil {
-				out = make(chan interface{})
-			}
-			d.SetOut(out)
+		if out != nil && !d.to.IsLaunched() {
+			d.to.SetOut(out)
 		}
-
-		if errors == nil {
-			errors = make(chan error)
-		}
-		d.SetErr(errors)
-
-		if d.from.Out() == nil {
-			d.from.SetOut(make(chan interface{}))
+		if errors != nil {
+			d.SetErr(errors)
 		}
 
-		//d.from.SetOut(d.to.In())
-		d.to.SetIn(d.from.Out())
-
+		// Every stage creates the channels it is missing with its own options,
+		// so the stages are started from left to right.
 		var err error
 
 		if !d.from.IsLaunched() {
@@ -86,7 +100,14 @@ func (d *daemonsConnectorInstance) AsDaemonFn() DaemonFn {
 			}
 		}
 
+		if d.errChan == nil {
+			d.errChan = d.from.Err()
+		}
+
 		if !d.to.IsLaunched() {
+			d.to.SetIn(d.from.Out())
+			d.to.SetErr(d.errChan)
+
 			d.to, err = d.to.Run(ctx)
 			if err != nil {
 				return err
@@ -101,6 +122,10 @@ func (d *daemonsConnectorInstance) IsLaunched() bool {
 	return d.from.IsLaunched() && d.to.IsLaunched()
 }
 
+func (d *daemonsConnectorInstance) Status() Status {
+	return combineStatus(d.from.Status(), d.to.Status())
+}
+
 func (d *daemonsConnectorInstance) SetIn(c chan interface{}) Daemon {
 	d.from.SetIn(c)
 	return d
@@ -133,6 +158,29 @@ func (d *daemonsConnectorInstance) Err() chan error {
 func (d *daemonsConnectorInstance) Stop() {
 	d.from.Stop()
 	d.to.Stop()
+	if d.cancel != nil {
+		d.cancel(ErrorStopped)
+	}
+}
+
+// Drain drains the stages from left to right: every stage closes its output
+// when it's done, which drains the next one.
+func (d *daemonsConnectorInstance) Drain(ctx context.Context) error {
+	if err := d.from.Drain(ctx); err != nil {
+		var drainErr *DrainError
+		if errors.As(err, &drainErr) {
+			busy := busyStages(d.to)
+			d.Stop()
+			d.Wait()
+			drainErr.Busy = append(drainErr.Busy, busy...)
+		}
+		return err
+	}
+
+	if waitContext(ctx, d.to) {
+		return nil
+	}
+	return drainTimeout(ctx, d)
 }
 
 func (d *daemonsConnectorInstance) Wait() {
@@ -140,6 +188,27 @@ func (d *daemonsConnectorInstance) Wait() {
 	d.to.Wait()
 }
 
+func (d *daemonsConnectorInstance) WaitErr() error {
+	return errors.Join(d.from.WaitErr(), d.to.WaitErr())
+}
+
+func (d *daemonsConnectorInstance) Cause() error {
+	if d.ctx == nil {
+		return nil
+	}
+	return context.Cause(d.ctx)
+}
+
+func (d *daemonsConnectorInstance) Name() string {
+	switch {
+	case d.from.Name() == "":
+		return d.to.Name()
+	case d.to.Name() == "":
+		return d.from.Name()
+	}
+	return d.from.Name() + " -> " + d.to.Name()
+}
+
 func (d *daemonsConnectorInstance) AsDaemon() Daemon {
 	return d
 }
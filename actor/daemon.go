@@ -2,11 +2,16 @@ package actor
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"sync"
-	"sync/atomic"
+	"time"
 )
 
+var ErrorStopped = fmt.Errorf("stopped")
+var ErrorAlreadyLaunched = fmt.Errorf("daemon already launched")
+var ErrorNotLaunched = fmt.Errorf("daemon not launched")
+
 type DaemonFn func(ctx context.Context, in chan interface{}, out chan interface{}, err chan error) error
 
 type Daemon interface {
@@ -22,10 +27,23 @@ type Daemon interface {
 	Out() chan interface{}
 	Err() chan error
 
+	Name() string
+
 	DisableCloseChannelsOnStop(disabled bool)
 	Close()
 	Stop()
+	// Drain closes the input, waits until the daemon finishes the messages it
+	// already has and stops. When ctx is done first the daemon is stopped
+	// right away and a *DrainError is returned.
+	Drain(ctx context.Context) error
 	Wait()
+	// WaitErr waits like Wait and returns the errors the daemon (and every stage inside it) failed with
+	WaitErr() error
+	// Cause returns why the daemon was cancelled, nil if it was not
+	Cause() error
+	Status() Status
+	// Stats returns a snapshot of the counters of the daemon
+	Stats() Stats
 	IsLaunched() bool
 	Clone() Daemon
 
@@ -34,23 +52,96 @@ type Daemon interface {
 }
 
 type daemonPrototype struct {
-	fn       DaemonFn
-	in       chan interface{}
-	out      chan interface{}
-	err      chan error
-	cancel   context.CancelFunc
-	wg       *sync.WaitGroup
-	launched uint32
+	fn    DaemonFn
+	opts  daemonOptions
+	state *daemonState
+
+	// describes the stages the daemon runs inside it, nil for a daemon without them
+	topology func(t *topologyBuilder, d *daemonPrototype) *describedNode
+}
+
+// Channels and lifecycle of one daemon instance. Run starts a copy of the
+// prototype with a fresh state, so a prototype can be run many times.
+type daemonState struct {
+	mu     sync.Mutex
+	status Status
+
+	in  chan interface{}
+	out chan interface{}
+	err chan error
 
 	disabledCloseChannelsOnStop bool
+	inClosed                    bool
+	outClosed                   bool
+
+	// set by Run before the instance is returned
+	ctx    context.Context
+	cancel context.CancelCauseFunc
+	done   chan struct{}
+
+	// set by the daemon goroutine before done is closed
+	runErr error
+	cause  error
+
+	stats     *daemonStats
+	startedAt time.Time
+	stoppedAt time.Time
+}
+
+// reportedError wraps errors that child stages already passed to their error policy.
+// A DaemonFn returns it to fail with these errors without reporting them twice.
+type reportedError struct {
+	error
+}
+
+func (e reportedError) Unwrap() error {
+	return e.error
+}
+
+// childErrors joins the errors the child stages failed with into a reportedError,
+// nil when none of them failed
+func childErrors(errs ...error) error {
+	if err := errors.Join(errs...); err != nil {
+		return reportedError{err}
+	}
+	return nil
 }
 
 func (d *daemonPrototype) Close() {
-	d.DisableCloseChannelsOnStop(true)
-	close(d.out)
-	close(d.in)
-	d.out = nil
-	d.in = nil
+	d.state.mu.Lock()
+	defer d.state.mu.Unlock()
+
+	d.state.disabledCloseChannelsOnStop = true
+	d.state.closeOut()
+	d.state.closeIn()
+}
+
+func (d *daemonPrototype) closeIn() {
+	d.state.mu.Lock()
+	defer d.state.mu.Unlock()
+
+	d.state.closeIn()
+}
+
+func (d *daemonPrototype) closeOut() {
+	d.state.mu.Lock()
+	defer d.state.mu.Unlock()
+
+	d.state.closeOut()
+}
+
+func (s *daemonState) closeIn() {
+	if s.in != nil && !s.inClosed {
+		s.inClosed = true
+		close(s.in)
+	}
+}
+
+func (s *daemonState) closeOut() {
+	if s.out != nil && !s.outClosed {
+		s.outClosed = true
+		close(s.out)
+	}
 }
 
 func (d *daemonPrototype) ConnectActor(actor Actor) Daemon {
@@ -62,117 +153,292 @@ func (d *daemonPrototype) ConnectDaemon(daemon Daemon) Daemon {
 }
 
 func (d *daemonPrototype) DisableCloseChannelsOnStop(disabled bool) {
-	d.disabledCloseChannelsOnStop = disabled
+	d.state.mu.Lock()
+	defer d.state.mu.Unlock()
+
+	d.state.disabledCloseChannelsOnStop = disabled
 }
 
+// Clone returns a not launched copy of the daemon.
+// A running daemon can't be copied, Clone returns the daemon itself.
 func (d *daemonPrototype) Clone() Daemon {
-	d2 := *d
-	return &d2
+	if d.IsLaunched() {
+		return d
+	}
+	return d.clone()
+}
+
+func (d *daemonPrototype) clone() *daemonPrototype {
+	d.state.mu.Lock()
+	defer d.state.mu.Unlock()
+
+	st := &daemonState{
+		err:                         d.state.err,
+		disabledCloseChannelsOnStop: d.state.disabledCloseChannelsOnStop,
+	}
+	// the channels a stopped instance closed are not carried over, the copy gets new ones
+	if !d.state.inClosed {
+		st.in = d.state.in
+	}
+	if !d.state.outClosed {
+		st.out = d.state.out
+	}
+
+	return &daemonPrototype{
+		fn:       d.fn,
+		opts:     d.opts,
+		state:    st,
+		topology: d.topology,
+	}
 }
 
 func (d *daemonPrototype) IsLaunched() bool {
-	return atomic.LoadUint32(&d.launched) == 1
+	return d.Status().IsActive()
 }
 
-func (d *daemonPrototype) Run(ctx context.Context) (Daemon, error) {
-	dCopy := *d
-	dl := &dCopy
+func (d *daemonPrototype) Status() Status {
+	d.state.mu.Lock()
+	defer d.state.mu.Unlock()
+
+	return d.state.status
+}
 
-	if dl.in == nil {
-		dl.in = make(chan interface{})
+func (d *daemonPrototype) setStatus(status Status) {
+	d.state.mu.Lock()
+	defer d.state.mu.Unlock()
+
+	d.state.status = status
+}
+
+func (d *daemonPrototype) Run(ctx context.Context) (Daemon, error) {
+	if d.IsLaunched() {
+		return d, ErrorAlreadyLaunched
 	}
-	if dl.out == nil {
-		dl.out = make(chan interface{})
+
+	dl := d.clone()
+	st := dl.state
+
+	if st.in == nil {
+		st.in = make(chan interface{}, dl.opts.inBuffer)
 	}
-	if dl.err == nil {
-		dl.err = make(chan error)
+	if st.out == nil {
+		st.out = make(chan interface{}, dl.opts.outBuffer)
 	}
-	if dl.wg == nil {
-		dl.wg = &sync.WaitGroup{}
+	if st.err == nil {
+		st.err = make(chan error, dl.opts.errBuffer)
 	}
+	st.status = StatusStarting
 
-	ctx, dl.cancel = context.WithCancel(ctx)
+	ctx, pipelineCancel := withPipeline(ctx)
+	ctx, st.cancel = context.WithCancelCause(ctx)
 
-	var runErr error
-	var launched = make(chan struct{})
+	stage := newStage(ctx, dl.opts)
+	stage.label = dl.stageName()
+	stage.stats = &daemonStats{}
+	st.stats = stage.stats
+	st.startedAt = time.Now()
+
+	ctx = withStage(ctx, stage)
+	st.ctx = ctx
+	st.done = make(chan struct{})
+
+	in, out, errChan := st.in, st.out, st.err
+	started := make(chan struct{})
 
-	dl.wg.Add(1)
 	go func() {
+		defer close(st.done)
 		defer func() {
-			if !dl.disabledCloseChannelsOnStop && dl.out != nil {
-				close(dl.out)
+			st.mu.Lock()
+			defer st.mu.Unlock()
+
+			if !st.disabledCloseChannelsOnStop {
+				st.closeOut()
 			}
 		}()
-		defer dl.wg.Done()
 
-		if !atomic.CompareAndSwapUint32(&dl.launched, 0, 1) {
-			runErr = fmt.Errorf("daemon already launched")
-			close(launched)
-			return
+		if pipelineCancel != nil {
+			defer pipelineCancel(nil)
 		}
 
-		defer func() {
-			atomic.CompareAndSwapUint32(&dl.launched, 1, 0)
-		}()
+		dl.setStatus(StatusRunning)
+		close(started)
+		dl.logStatus(StatusRunning, nil)
 
-		close(launched)
+		err := dl.finish(ctx, errChan, dl.fn.safeRun(ctx, dl.stageName(), in, out, errChan))
+		if err != nil {
+			dl.logStatus(StatusFailed, err)
+		} else {
+			dl.logStatus(StatusStopped, nil)
+		}
 
-		if runErr = dl.fn(ctx, dl.in, dl.out, dl.err); runErr != nil {
-			select {
-			case <-ctx.Done():
-				return
-			case dl.err <- runErr:
-			}
+		st.mu.Lock()
+		defer st.mu.Unlock()
+
+		st.runErr = err
+		st.cause = context.Cause(ctx)
+		st.stoppedAt = time.Now()
+		// release the context of the stopped daemon
+		st.cancel(nil)
+		st.status = StatusStopped
+		if err != nil {
+			st.status = StatusFailed
 		}
 	}()
 
-	<-launched
+	<-started
 
-	return dl, runErr
+	return dl, nil
+}
+
+// finish reports the error returned by the DaemonFn and returns the error the run failed with
+func (d *daemonPrototype) finish(ctx context.Context, errChan chan error, err error) error {
+	if err == nil {
+		return nil
+	}
+
+	if reported, ok := err.(reportedError); ok {
+		err = reported.error
+	} else {
+		// DaemonFn returned because of the cancel
+		if ctx.Err() != nil && errors.Is(err, ctx.Err()) {
+			return nil
+		}
+
+		err = newStageError(d.stageName(), nil, err)
+
+		// errors after cancel are caused by the cancel itself (e.g. ErrorPolicyStop)
+		if ctx.Err() == nil && !stageFromContext(ctx).supervised {
+			reportError(ctx, errChan, err)
+		}
+	}
+
+	stageFromContext(ctx).stats.setLastError(err)
+
+	if d.opts.failFast {
+		cancelPipeline(ctx, err)
+	}
+
+	return err
 }
 
 func (d *daemonPrototype) SetIn(in chan interface{}) Daemon {
-	d.in = in
+	d.state.mu.Lock()
+	defer d.state.mu.Unlock()
+
+	d.state.in = in
+	d.state.inClosed = false
 	return d
 }
 
 func (d *daemonPrototype) SetOut(out chan interface{}) Daemon {
-	d.out = out
+	d.state.mu.Lock()
+	defer d.state.mu.Unlock()
+
+	d.state.out = out
+	d.state.outClosed = false
 	return d
 }
 
 func (d *daemonPrototype) SetErr(err chan error) Daemon {
-	d.err = err
+	d.state.mu.Lock()
+	defer d.state.mu.Unlock()
+
+	d.state.err = err
 	return d
 }
 
 func (d *daemonPrototype) In() chan interface{} {
-	return d.in
+	d.state.mu.Lock()
+	defer d.state.mu.Unlock()
+
+	return d.state.in
 }
 
 func (d *daemonPrototype) Out() chan interface{} {
-	return d.out
+	d.state.mu.Lock()
+	defer d.state.mu.Unlock()
+
+	return d.state.out
 }
 
 func (d *daemonPrototype) Err() chan error {
-	return d.err
+	d.state.mu.Lock()
+	defer d.state.mu.Unlock()
+
+	return d.state.err
 }
 
 func (d *daemonPrototype) Stop() {
-	if atomic.LoadUint32(&d.launched) == 0 {
-		return
+	if d.state.cancel != nil {
+		d.state.cancel(ErrorStopped)
+	}
+}
+
+func (d *daemonPrototype) Drain(ctx context.Context) error {
+	if d.state.done == nil {
+		return nil
+	}
+
+	d.state.mu.Lock()
+	draining := d.state.status == StatusRunning
+	if draining {
+		d.state.status = StatusDraining
 	}
+	d.state.closeIn()
+	d.state.mu.Unlock()
 
-	if d.cancel != nil {
-		d.cancel()
-		d.cancel = nil
+	if draining {
+		d.logStatus(StatusDraining, nil)
 	}
+
+	if waitContext(ctx, d) {
+		return nil
+	}
+	return drainTimeout(ctx, d)
 }
 
 func (d *daemonPrototype) Wait() {
-	if d.wg != nil {
-		d.wg.Wait()
+	if d.state.done != nil {
+		<-d.state.done
+	}
+}
+
+func (d *daemonPrototype) WaitErr() error {
+	d.Wait()
+
+	d.state.mu.Lock()
+	defer d.state.mu.Unlock()
+
+	return d.state.runErr
+}
+
+func (d *daemonPrototype) Cause() error {
+	if d.state.done == nil {
+		return nil
+	}
+
+	d.state.mu.Lock()
+	defer d.state.mu.Unlock()
+
+	// the context of a stopped daemon is cancelled without a cause
+	if !d.state.stoppedAt.IsZero() {
+		return d.state.cause
+	}
+	return context.Cause(d.state.ctx)
+}
+
+func (d *daemonPrototype) Name() string {
+	return d.opts.name
+}
+
+func (d *daemonPrototype) stageName() string {
+	if d.opts.name != "" {
+		return d.opts.name
+	}
+	if d.opts.defaultName != "" {
+		return d.opts.defaultName
 	}
+	return funcName(d.fn)
 }
 
 func (d *daemonPrototype) AsDaemon() Daemon {
@@ -183,8 +449,10 @@ func (d *daemonPrototype) AsDaemonFn() DaemonFn {
 	return d.fn
 }
 
-func NewDaemon(fn DaemonFn) Daemon {
+func NewDaemon(fn DaemonFn, opts ...DaemonOption) Daemon {
 	return &daemonPrototype{
-		fn: fn,
+		fn:    fn,
+		opts:  newDaemonOptions(opts),
+		state: &daemonState{},
 	}
 }
@@ -2,112 +2,260 @@ package actor
 
 import (
 	"context"
+	"fmt"
 	"sync"
 )
 
-func NewDaemonsCluster(size int, daemon Daemon) Daemon {
-	return NewDaemon(func(ctx context.Context, in chan interface{}, out chan interface{}, errChan chan error) error {
-		if in == nil {
-			in = make(chan interface{})
-		}
-		if out == nil {
-			out = make(chan interface{})
-		}
-		if errChan == nil {
-			errChan = make(chan error)
-		}
+var ErrorClusterSize = fmt.Errorf("cluster size must be positive")
 
-		daemons := make([]Daemon, 0, size)
-		for id := 0; id < size; id++ {
-			d := daemon.Clone()
+// ErrorNoWorkers is reported for the messages of the stopped workers no other worker can take
+var ErrorNoWorkers = fmt.Errorf("no cluster workers left")
 
-			d.DisableCloseChannelsOnStop(true)
-			d.SetIn(in)
-			d.SetOut(out)
-			d.SetErr(errChan)
+// DaemonsCluster runs clones of a daemon that take messages from the same input
+type DaemonsCluster interface {
+	Daemon
 
-			daemonInstance, err := d.Run(ctx)
-			if err != nil {
-				return err
-			}
-			daemons = append(daemons, daemonInstance)
-		}
+	RunCluster(ctx context.Context) (DaemonsCluster, error)
+	// Size returns the number of workers, not counting the retiring ones
+	Size() int
+	// Resize starts new workers or retires the extra ones. A retiring worker
+	// finishes its current message and stops. Resize of a not launched cluster
+	// sets the number of workers it starts with.
+	Resize(n int) error
+	Load() ClusterLoad
+	// InFlight returns the number of messages every worker processes or has waiting
+	InFlight() []int
+	AsDaemonsCluster() DaemonsCluster
+}
 
-		wait := make(chan struct{})
-		go func() {
-			defer close(wait)
-			for _, d := range daemons {
-				d.Wait()
-			}
-		}()
-
-		for {
-			select {
-			case <-ctx.Done():
-				for _, d := range daemons {
-					d.Stop()
-				}
-				<-wait
-			case <-wait:
-				return nil
-			}
-		}
-	})
+// ClusterLoad is a snapshot of the cluster workload
+type ClusterLoad struct {
+	Size int
+	// workers that have a message waiting for them
+	Busy int
+	// messages in the input channel buffer
+	Queued int
+}
+
+type daemonsCluster struct {
+	*daemonPrototype
+
+	factory  DaemonFactory
+	size     int
+	balancer Balancer
+	// the daemon the workers are cloned from, nil with a factory
+	daemon Daemon
+	// workers of the running cluster, nil until Run
+	workers *clusterWorkers
+}
+
+// DaemonFactory creates the daemon of a cluster worker. It's called for every worker,
+// so the state the daemon captures isn't shared with the other workers.
+type DaemonFactory func(workerID int) Daemon
+
+func NewDaemonsCluster(size int, daemon Daemon, opts ...DaemonOption) DaemonsCluster {
+	return NewBalancedDaemonsCluster(size, nil, daemon, opts...)
+}
+
+// NewDaemonsClusterWithFactory works like NewDaemonsCluster but creates every worker with factory
+func NewDaemonsClusterWithFactory(size int, factory DaemonFactory, opts ...DaemonOption) DaemonsCluster {
+	return newDaemonsCluster(size, nil, factory, opts)
+}
+
+// NewBalancedDaemonsCluster works like NewDaemonsCluster but every worker has its own
+// queue and the balancer picks the queue for every message. The queues have the
+// capacity of the cluster input buffer (WithInBuffer), at least one message.
+// A nil balancer makes the workers take messages from the shared input.
+func NewBalancedDaemonsCluster(size int, balancer Balancer, daemon Daemon, opts ...DaemonOption) DaemonsCluster {
+	c := newDaemonsCluster(size, balancer, cloneFactory(daemon), opts)
+	c.daemon = daemon
+	return c
+}
+
+// cloneFactory creates the workers as clones of daemon
+func cloneFactory(daemon Daemon) DaemonFactory {
+	return func(int) Daemon {
+		return daemon
+	}
+}
+
+func newDaemonsCluster(size int, balancer Balancer, factory DaemonFactory, opts []DaemonOption) *daemonsCluster {
+	c := &daemonsCluster{
+		factory:  factory,
+		size:     size,
+		balancer: balancer,
+	}
+	c.daemonPrototype = NewDaemon(c.AsDaemonFn(), clusterOptions(NewDaemonsCluster, opts)...).(*daemonPrototype)
+
+	return c
+}
+
+// clusterOptions names an unnamed cluster after its constructor, so the name
+// doesn't depend on the DaemonFn a running cluster gets for its workers
+func clusterOptions(constructor interface{}, opts []DaemonOption) []DaemonOption {
+	return append([]DaemonOption{withDefaultName(funcName(constructor))}, opts...)
+}
+
+func (c *daemonsCluster) Run(ctx context.Context) (Daemon, error) {
+	return c.RunCluster(ctx)
+}
+
+func (c *daemonsCluster) RunCluster(ctx context.Context) (DaemonsCluster, error) {
+	if c.IsLaunched() {
+		return c, ErrorAlreadyLaunched
+	}
+
+	workers := newClusterWorkers(c.factory, c.size, c.balancer)
+
+	p := c.daemonPrototype.clone()
+	p.fn = workers.run
+
+	dl, err := p.Run(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return &daemonsCluster{
+		daemonPrototype: dl.(*daemonPrototype),
+		factory:         c.factory,
+		size:            c.size,
+		balancer:        c.balancer,
+		daemon:          c.daemon,
+		workers:         workers,
+	}, nil
+}
+
+func (c *daemonsCluster) AsDaemonFn() DaemonFn {
+	return func(ctx context.Context, in chan interface{}, out chan interface{}, errChan chan error) error {
+		return newClusterWorkers(c.factory, c.size, c.balancer).run(ctx, in, out, errChan)
+	}
+}
+
+func (c *daemonsCluster) Clone() Daemon {
+	if c.IsLaunched() {
+		return c
+	}
+
+	return &daemonsCluster{
+		daemonPrototype: c.daemonPrototype.clone(),
+		factory:         c.factory,
+		size:            c.size,
+		balancer:        c.balancer,
+		daemon:          c.daemon,
+	}
+}
+
+func (c *daemonsCluster) Size() int {
+	if c.workers == nil {
+		return c.size
+	}
+	return c.workers.Load().Size
+}
+
+func (c *daemonsCluster) Resize(n int) error {
+	if n < 1 {
+		return ErrorClusterSize
+	}
+
+	if c.workers == nil {
+		c.size = n
+		return nil
+	}
+	return c.workers.resize(n)
+}
+
+func (c *daemonsCluster) Load() ClusterLoad {
+	if c.workers == nil {
+		return ClusterLoad{Size: c.size}
+	}
+	return c.workers.Load()
+}
+
+func (c *daemonsCluster) InFlight() []int {
+	if c.workers == nil {
+		return make([]int, c.size)
+	}
+	return c.workers.InFlight()
+}
+
+func (c *daemonsCluster) ConnectActor(actor Actor) Daemon {
+	return NewDaemonActorConnector(c, actor)
+}
+
+func (c *daemonsCluster) ConnectDaemon(daemon Daemon) Daemon {
+	return NewDaemonsConnector(c, daemon)
+}
+
+func (c *daemonsCluster) AsDaemon() Daemon {
+	return c
+}
+
+func (c *daemonsCluster) AsDaemonsCluster() DaemonsCluster {
+	return c
 }
 
-func NewDaemonsClusterWithBroadcast(size int, daemon Daemon) (broadcast Daemon, cluster Daemon) {
-	in := make(chan interface{})
+func NewDaemonsClusterWithBroadcast(size int, daemon Daemon, opts ...DaemonOption) (broadcast Daemon, cluster Daemon) {
+	return NewDaemonsClusterWithBroadcastFactory(size, cloneFactory(daemon), opts...)
+}
+
+// NewDaemonsClusterWithBroadcastFactory works like NewDaemonsClusterWithBroadcast
+// but creates every worker with factory. The options are set on both the broadcast
+// and the cluster.
+func NewDaemonsClusterWithBroadcastFactory(size int, factory DaemonFactory, opts ...DaemonOption) (broadcast Daemon, cluster Daemon) {
 	out := make(chan interface{})
 	errChan := make(chan error)
 
 	daemons := make([]Daemon, 0, size)
 	for id := 0; id < size; id++ {
-		d := daemon.Clone()
+		d := factory(id).Clone()
 
+		// every worker gets every message through its own input
 		d.DisableCloseChannelsOnStop(true)
-		d.SetIn(in)
+		d.SetIn(make(chan interface{}))
 		d.SetOut(out)
 		d.SetErr(errChan)
 
 		daemons = append(daemons, d)
 	}
 
-	cluster = NewDaemon(func(ctx context.Context, in chan interface{}, out chan interface{}, err chan error) error {
+	fn := DaemonFn(func(ctx context.Context, in chan interface{}, out chan interface{}, err chan error) error {
 		clusterCtx, clusterCancel := context.WithCancel(ctx)
 
+		defer clusterCancel()
+
+		errs := make([]error, len(daemons))
 		wg := &sync.WaitGroup{}
-		for _, d := range daemons {
+		for id, d := range daemons {
 			wg.Add(1)
-			go func() {
+			go func(id int, fn DaemonFn, stage string, in chan interface{}) {
 				defer wg.Done()
-				if err := d.AsDaemonFn()(clusterCtx, in, out, err); err != nil {
-					select {
-					case <-clusterCtx.Done():
-						return
-					case errChan <- err:
-					}
+				if stage == "" {
+					stage = funcName(fn)
+				}
+
+				workerCtx := withWorker(clusterCtx, StageName(ctx), id)
+				if err := fn.safeRun(workerCtx, stage, in, out, err); err != nil && clusterCtx.Err() == nil {
+					errs[id] = newStageError(stage, nil, err)
+					reportError(clusterCtx, errChan, errs[id])
 				}
-			}()
+			}(id, d.AsDaemonFn(), d.Name(), d.In())
 		}
 
-		wait := make(chan struct{})
-		go func() {
-			defer close(wait)
-			wg.Wait()
-		}()
-
-		for {
-			select {
-			case <-ctx.Done():
-				clusterCancel()
-				wg.Wait()
-			case <-wait:
-				return nil
-			}
+		wg.Wait()
+
+		return childErrors(errs...)
+	})
+
+	cluster = NewDaemon(fn, opts...).SetOut(out).SetErr(errChan).(*daemonPrototype).withTopology(func(t *topologyBuilder, d *daemonPrototype) *describedNode {
+		var worker interface{}
+		if len(daemons) > 0 {
+			worker = daemons[0]
 		}
-	}).SetIn(in).SetOut(out).SetErr(errChan)
+		return t.describeCluster(d, len(daemons), worker)
+	})
 
-	broadcast = NewBroadcastDaemon(daemons...)
+	// the workers are run by the cluster
+	broadcast = newBroadcastDaemon(daemons, false, opts...)
 
 	return broadcast, cluster
 }
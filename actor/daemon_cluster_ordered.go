@@ -0,0 +1,160 @@
+package actor
+
+import (
+	"context"
+	"sort"
+	"sync"
+)
+
+// sequenced is an input of the ordered cluster tagged with its position in the stream.
+// Actor daemons reply to every sequenced input with exactly one sequenced output.
+type sequenced struct {
+	seq  uint64
+	data interface{}
+}
+
+// NewOrderedDaemonsCluster works like NewDaemonsCluster but emits the results in the
+// input order. Inputs are tagged with a sequence number, so the workers must be built
+// of actors (ActorFn.AsDaemon and actor connectors), which pass the tag through.
+//
+// At most bound messages are processed at once: a slow message holds back the input
+// instead of growing the reorder buffer. A bound less than 1 means size.
+//
+// A message the cluster can't pass to a worker is reported with ErrorNoWorkers and
+// skipped. When the workers stop, the results held back by a missing one are emitted.
+func NewOrderedDaemonsCluster(size int, bound int, daemon Daemon, opts ...DaemonOption) Daemon {
+	if bound < 1 {
+		bound = size
+	}
+
+	fn := DaemonFn(func(ctx context.Context, in chan interface{}, out chan interface{}, errChan chan error) error {
+		workersIn := make(chan interface{})
+		workersOut := make(chan interface{})
+
+		// the setters return the prototype, so they aren't chained to Run
+		cluster := NewDaemonsCluster(size, daemon, WithName(StageName(ctx)))
+		cluster.SetIn(workersIn).SetOut(workersOut).SetErr(errChan)
+
+		cluster, err := cluster.RunCluster(ctx)
+		if err != nil {
+			return err
+		}
+
+		// the workers emit to the cluster, only their errors and calls are added up
+		stageFromContext(ctx).stats.setInner(func(stats *Stats) {
+			inner := cluster.Stats()
+			stats.Errors += inner.Errors
+			stats.InFlight += inner.InFlight
+			if stats.LastError == nil {
+				stats.LastError = inner.LastError
+			}
+			stats.Workers = inner.Workers
+		})
+
+		slots := make(chan struct{}, bound)
+		done := make(chan struct{})
+		wg := &sync.WaitGroup{}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer close(workersIn)
+
+			for seq := uint64(0); ; seq++ {
+				select {
+				case <-done:
+					return
+				case slots <- struct{}{}:
+				}
+
+				select {
+				case <-done:
+					return
+				case inData, ok := <-in:
+					if !ok {
+						return
+					}
+					stageFromContext(ctx).stats.received()
+					observeReceived(ctx)
+
+					select {
+					case <-done:
+						return
+					case workersIn <- sequenced{seq: seq, data: inData}:
+					}
+				}
+			}
+		}()
+
+		defer wg.Wait()
+		defer close(done)
+
+		pending := make(map[uint64]interface{}, bound)
+		var next uint64
+
+		for outData := range workersOut {
+			s, ok := outData.(sequenced)
+			if !ok {
+				// the worker doesn't pass the tag through, the order is lost
+				cluster.Stop()
+				cluster.Wait()
+				return ErrorOutputFormat
+			}
+
+			pending[s.seq] = s.data
+			for {
+				data, ok := pending[next]
+				if !ok {
+					break
+				}
+
+				delete(pending, next)
+				next++
+				<-slots
+
+				emit(ctx, out, data)
+			}
+		}
+
+		// the workers have stopped, the missing results can't arrive anymore
+		seqs := make([]uint64, 0, len(pending))
+		for seq := range pending {
+			seqs = append(seqs, seq)
+		}
+		sort.Slice(seqs, func(i, j int) bool { return seqs[i] < seqs[j] })
+		for _, seq := range seqs {
+			emit(ctx, out, pending[seq])
+		}
+
+		return childErrors(cluster.WaitErr())
+	})
+
+	return NewDaemon(fn, clusterOptions(NewOrderedDaemonsCluster, opts)...).(*daemonPrototype).withTopology(func(t *topologyBuilder, d *daemonPrototype) *describedNode {
+		return t.describeCluster(d, size, daemon)
+	})
+}
+
+// callSequenced calls the actor for a sequenced input and replies with exactly one
+// sequenced output, even when the input is dropped or failed, so the ordered cluster
+// never waits for it. Returns true when the stage has to stop.
+func (fn ActorFn) callSequenced(ctx context.Context, stage string, in sequenced, out chan interface{}, errChan chan error) (bool, error) {
+	call := ActorFn(func(ctx context.Context, inData interface{}) (interface{}, error) {
+		return fn.safeCallEnvelope(ctx, stage, inData)
+	})
+
+	var stop bool
+	outData, err := callEach(ctx, call, in.data)
+	switch {
+	case isEndOfStream(err):
+		stop, err = true, nil
+	case err != nil:
+		outData = Drop
+		err = reportError(ctx, errChan, newStageError(stage, in.data, err))
+		stop = err != nil
+	}
+
+	if !emit(ctx, out, sequenced{seq: in.seq, data: outData}) {
+		return true, nil
+	}
+	return stop, err
+}
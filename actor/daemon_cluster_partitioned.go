@@ -0,0 +1,112 @@
+package actor
+
+import "context"
+
+// KeyFn returns the partition key of a message, the payload of an enveloped one
+type KeyFn func(in interface{}) string
+
+// NewPartitionedCluster runs size clones of daemon, each with its own input channel.
+// Messages are routed by consistent hashing of keyFn(message), so the messages with
+// the same key are processed in order by one worker while different keys run in parallel.
+// When a worker stops its keys move to the other workers.
+func NewPartitionedCluster(size int, keyFn KeyFn, daemon Daemon, opts ...DaemonOption) Daemon {
+	fn := DaemonFn(func(ctx context.Context, in chan interface{}, out chan interface{}, errChan chan error) error {
+		workers := make([]Daemon, 0, size)
+		ring := &hashRing{}
+		cluster := StageName(ctx)
+
+		for id := 0; id < size; id++ {
+			d := daemon.Clone()
+
+			d.DisableCloseChannelsOnStop(true)
+			d.SetIn(make(chan interface{}))
+			d.SetOut(out)
+			d.SetErr(errChan)
+
+			worker, err := d.Run(withWorker(ctx, cluster, id))
+			if err != nil {
+				for _, w := range workers {
+					w.Stop()
+					w.Wait()
+				}
+				return err
+			}
+
+			workers = append(workers, worker)
+			ring.add(id)
+		}
+
+		stageFromContext(ctx).stats.setInner(func(stats *Stats) {
+			stats.addWorkers(workers)
+		})
+
+		errs := make([]error, len(workers))
+		exits := make(chan int, len(workers))
+		for id, w := range workers {
+			go func(id int, w Daemon) {
+				errs[id] = w.WaitErr()
+				exits <- id
+			}(id, w)
+		}
+
+		alive := len(workers)
+		exited := func(id int) {
+			ring.remove(id)
+			alive--
+		}
+
+		// the message no worker is left to take is reported like in a cluster
+		var lost error
+
+	dispatch:
+		for alive > 0 {
+			select {
+			case <-ctx.Done():
+				break dispatch
+
+			case id := <-exits:
+				exited(id)
+
+			case inData, ok := <-in:
+				if !ok {
+					break dispatch
+				}
+
+				stageFromContext(ctx).stats.received()
+				observeReceived(ctx)
+
+				key := keyFn(Payload(inData))
+				for sent := false; !sent; {
+					id := ring.get(key)
+					if id < 0 {
+						lost = newStageError(cluster, inData, ErrorNoWorkers)
+						reportError(ctx, errChan, lost)
+						break dispatch
+					}
+
+					select {
+					case <-ctx.Done():
+						break dispatch
+					case id := <-exits:
+						exited(id)
+					case workers[id].In() <- inData:
+						sent = true
+					}
+				}
+			}
+		}
+
+		for _, w := range workers {
+			closeDaemonIn(w)
+		}
+		for ; alive > 0; alive-- {
+			<-exits
+		}
+
+		return childErrors(append(errs, lost)...)
+	})
+
+	return NewDaemon(fn, clusterOptions(NewPartitionedCluster, opts)...).(*daemonPrototype).withTopology(func(t *topologyBuilder, d *daemonPrototype) *describedNode {
+		return t.describeCluster(d, size, daemon)
+	})
+}
@@ -0,0 +1,102 @@
+package actor
+
+import "log/slog"
+
+type DaemonOption func(o *daemonOptions)
+
+type daemonOptions struct {
+	name        string
+	defaultName string
+	inBuffer    int
+	outBuffer   int
+	errBuffer   int
+	errorPolicy ErrorPolicy
+	metrics     Metrics
+	spans       SpanExporter
+	logger      *slog.Logger
+	failFast    bool
+}
+
+func newDaemonOptions(opts []DaemonOption) daemonOptions {
+	var o daemonOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return o
+}
+
+// WithName sets a human-readable stage name used in errors
+func WithName(name string) DaemonOption {
+	return func(o *daemonOptions) {
+		o.name = name
+	}
+}
+
+// withDefaultName sets the stage name of a daemon without WithName
+func withDefaultName(name string) DaemonOption {
+	return func(o *daemonOptions) {
+		o.defaultName = name
+	}
+}
+
+// WithBuffer sets the capacity of the in and out channels created by Run
+func WithBuffer(size int) DaemonOption {
+	return func(o *daemonOptions) {
+		o.inBuffer = size
+		o.outBuffer = size
+	}
+}
+
+func WithInBuffer(size int) DaemonOption {
+	return func(o *daemonOptions) {
+		o.inBuffer = size
+	}
+}
+
+func WithOutBuffer(size int) DaemonOption {
+	return func(o *daemonOptions) {
+		o.outBuffer = size
+	}
+}
+
+func WithErrBuffer(size int) DaemonOption {
+	return func(o *daemonOptions) {
+		o.errBuffer = size
+	}
+}
+
+// WithErrorPolicy sets how errors are delivered to the Err() channel
+func WithErrorPolicy(policy ErrorPolicy) DaemonOption {
+	return func(o *daemonOptions) {
+		o.errorPolicy = policy
+	}
+}
+
+// WithMetrics sets where the daemon and the stages inside it send their metrics
+func WithMetrics(metrics Metrics) DaemonOption {
+	return func(o *daemonOptions) {
+		o.metrics = metrics
+	}
+}
+
+// WithSpanExporter sets where the daemon and the stages inside it export their spans
+func WithSpanExporter(exporter SpanExporter) DaemonOption {
+	return func(o *daemonOptions) {
+		o.spans = exporter
+	}
+}
+
+// WithLogger sets the logger of the daemon and the stages inside it
+func WithLogger(logger *slog.Logger) DaemonOption {
+	return func(o *daemonOptions) {
+		o.logger = logger
+	}
+}
+
+// WithFailFast cancels the whole pipeline with the daemon error as the cause
+// when the DaemonFn fails
+func WithFailFast() DaemonOption {
+	return func(o *daemonOptions) {
+		o.failFast = true
+	}
+}
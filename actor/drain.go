@@ -0,0 +1,74 @@
+package actor
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+// DrainError is returned by Drain when the deadline passed before the
+// pipeline finished its backlog. Busy lists the stages that were still working.
+type DrainError struct {
+	Busy []string
+	Err  error
+}
+
+func (e *DrainError) Error() string {
+	return fmt.Sprintf("drain: %v, busy stages: %s", e.Err, strings.Join(e.Busy, ", "))
+}
+
+func (e *DrainError) Unwrap() error {
+	return e.Err
+}
+
+// waitContext waits for the daemon until ctx is done. Returns false if ctx is done first.
+func waitContext(ctx context.Context, d Daemon) bool {
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		d.Wait()
+	}()
+
+	select {
+	case <-done:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// busyStages returns the names of the stages of d that are not done yet
+func busyStages(d Daemon) []string {
+	if c, ok := d.(DaemonsConnector); ok {
+		return append(busyStages(c.From()), busyStages(c.To())...)
+	}
+
+	if d.Status().IsDone() {
+		return nil
+	}
+	return []string{stageLabel(d)}
+}
+
+func stageLabel(d Daemon) string {
+	// the stages made of a daemon prototype have its name
+	if p, ok := d.(interface{ stageName() string }); ok {
+		return p.stageName()
+	}
+	if name := d.Name(); name != "" {
+		return name
+	}
+	return fmt.Sprintf("%T", d)
+}
+
+// drainTimeout hard stops d after a failed drain and returns the drain error
+func drainTimeout(ctx context.Context, d Daemon) error {
+	busy := busyStages(d)
+
+	d.Stop()
+	d.Wait()
+
+	return &DrainError{
+		Busy: busy,
+		Err:  ctx.Err(),
+	}
+}
@@ -0,0 +1,139 @@
+package actor
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"time"
+)
+
+type envelopeContextKey struct{}
+
+// Envelope carries a message payload with its metadata through the stages.
+// Actors get the payload of an enveloped message and their outputs are put
+// into copies of the envelope. An actor reads or changes the envelope of the
+// current message with EnvelopeFromContext, or returns an *Envelope to replace it.
+// Connectors, clusters, routers and broadcasts pass envelopes through as they are.
+type Envelope struct {
+	ID        string            `json:"id"`
+	Headers   map[string]string `json:"headers,omitempty"`
+	CreatedAt time.Time         `json:"created_at"`
+	Retries   int               `json:"retries,omitempty"`
+
+	// trace context of the message
+	TraceID string `json:"trace_id,omitempty"`
+	SpanID  string `json:"span_id,omitempty"`
+
+	Payload interface{} `json:"-"`
+
+	// the stage that emitted the message and when, for the hop spans
+	from string
+	sent time.Time
+}
+
+// NewEnvelope puts payload into an envelope with a random ID
+func NewEnvelope(payload interface{}) *Envelope {
+	return &Envelope{
+		ID:        randomID(16),
+		CreatedAt: time.Now(),
+		Payload:   payload,
+	}
+}
+
+// randomID returns size random bytes in hex
+func randomID(size int) string {
+	id := make([]byte, size)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+func (e *Envelope) Header(key string) string {
+	return e.Headers[key]
+}
+
+func (e *Envelope) SetHeader(key string, value string) {
+	if e.Headers == nil {
+		e.Headers = make(map[string]string)
+	}
+	e.Headers[key] = value
+}
+
+// WithPayload returns a copy of the envelope with another payload
+func (e *Envelope) WithPayload(payload interface{}) *Envelope {
+	e2 := *e
+	e2.Payload = payload
+	if e.Headers != nil {
+		e2.Headers = make(map[string]string, len(e.Headers))
+		for k, v := range e.Headers {
+			e2.Headers[k] = v
+		}
+	}
+	return &e2
+}
+
+// EnvelopeFromContext returns the envelope of the message the current actor is called with,
+// nil when the message isn't enveloped. Changes of the envelope go to the actor outputs.
+func EnvelopeFromContext(ctx context.Context) *Envelope {
+	e, _ := ctx.Value(envelopeContextKey{}).(*Envelope)
+	return e
+}
+
+// Payload returns the payload of an enveloped message or the message itself
+func Payload(msg interface{}) interface{} {
+	if e, ok := msg.(*Envelope); ok {
+		return e.Payload
+	}
+	return msg
+}
+
+// openEnvelope returns the payload of an enveloped message and the context with a copy
+// of its envelope, so the stages sharing the message don't change each other's envelope
+func openEnvelope(ctx context.Context, in interface{}) (context.Context, interface{}, *Envelope) {
+	e, ok := in.(*Envelope)
+	if !ok {
+		return ctx, in, nil
+	}
+
+	e = e.WithPayload(nil)
+	return context.WithValue(ctx, envelopeContextKey{}, e), Payload(in), e
+}
+
+// seal puts an actor output into copies of the envelope. Drop and the
+// envelopes returned by the actor are kept as they are.
+func (e *Envelope) seal(out interface{}) interface{} {
+	if e == nil || IsDropped(out) {
+		return out
+	}
+
+	switch o := out.(type) {
+	case *Envelope:
+		return o
+	case Outputs:
+		sealed := make(Outputs, len(o))
+		for i := range o {
+			sealed[i] = e.seal(o[i])
+		}
+		return sealed
+	}
+
+	return e.WithPayload(out)
+}
+
+// safeCallEnvelope calls the actor with the payload of an enveloped input
+// and puts the output into the envelope
+func (fn ActorFn) safeCallEnvelope(ctx context.Context, stage string, in interface{}) (interface{}, error) {
+	ctx, payload, e := openEnvelope(ctx, in)
+
+	stats := stageFromContext(ctx).stats
+	stats.called(1)
+	defer stats.called(-1)
+
+	start := time.Now()
+	span := startSpan(ctx, stage, e, start)
+
+	out, err := fn.safeCall(ctx, stage, payload)
+	observeCall(ctx, stage, start, err)
+	span.finish(ctx, e, err)
+
+	return e.seal(out), err
+}
@@ -0,0 +1,125 @@
+package actor
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sync/atomic"
+)
+
+// ErrorPolicy delivers a stage error. A non-nil result stops the stage with that error.
+type ErrorPolicy interface {
+	HandleError(ctx context.Context, errChan chan error, err error) error
+}
+
+type ErrorPolicyFn func(ctx context.Context, errChan chan error, err error) error
+
+func (fn ErrorPolicyFn) HandleError(ctx context.Context, errChan chan error, err error) error {
+	return fn(ctx, errChan, err)
+}
+
+// StageError is an error of one stage call. Input is nil for errors returned by a DaemonFn.
+type StageError struct {
+	Stage string
+	Input interface{}
+	Err   error
+}
+
+func (e *StageError) Error() string {
+	return fmt.Sprintf("stage %s: %v", e.Stage, e.Err)
+}
+
+func (e *StageError) Unwrap() error {
+	return e.Err
+}
+
+func newStageError(stage string, input interface{}, err error) error {
+	if _, ok := err.(*StageError); ok {
+		return err
+	}
+
+	return &StageError{
+		Stage: stage,
+		Input: input,
+		Err:   err,
+	}
+}
+
+// ErrorPolicyBlock waits until the error is read from Err() or the stage is stopped
+var ErrorPolicyBlock ErrorPolicy = ErrorPolicyFn(func(ctx context.Context, errChan chan error, err error) error {
+	select {
+	case <-ctx.Done():
+	case errChan <- err:
+	}
+	return nil
+})
+
+// ErrorPolicyDrop sends the error only if someone is ready to read it
+var ErrorPolicyDrop ErrorPolicy = ErrorPolicyFn(func(ctx context.Context, errChan chan error, err error) error {
+	select {
+	case errChan <- err:
+	default:
+	}
+	return nil
+})
+
+// ErrorPolicyStop offers the error to Err() and stops the whole pipeline the stage belongs to
+var ErrorPolicyStop ErrorPolicy = ErrorPolicyFn(func(ctx context.Context, errChan chan error, err error) error {
+	ErrorPolicyDrop.HandleError(ctx, errChan, err)
+	cancelPipeline(ctx, err)
+	return err
+})
+
+// CountErrorPolicy ignores errors and counts them
+type CountErrorPolicy struct {
+	count uint64
+}
+
+func (p *CountErrorPolicy) HandleError(ctx context.Context, errChan chan error, err error) error {
+	atomic.AddUint64(&p.count, 1)
+	return nil
+}
+
+func (p *CountErrorPolicy) Count() uint64 {
+	return atomic.LoadUint64(&p.count)
+}
+
+func NewCountErrorPolicy() *CountErrorPolicy {
+	return &CountErrorPolicy{}
+}
+
+// NewLogErrorPolicy logs errors instead of sending them to Err(). The stages with their
+// own logger (WithLogger) have already logged the error, the others log it to logger.
+// A nil logger means slog.Default().
+func NewLogErrorPolicy(logger *slog.Logger) ErrorPolicy {
+	if logger == nil {
+		logger = slog.Default()
+	}
+
+	return ErrorPolicyFn(func(ctx context.Context, errChan chan error, err error) error {
+		if stageLogger(ctx) == nil {
+			withStageAttrs(ctx, logger).Warn("stage error", "err", err)
+		}
+		return nil
+	})
+}
+
+// NewDeadLetterErrorPolicy sends errors to the In() of a running dead-letter daemon.
+// Errors of actor calls are *StageError values carrying the failed input.
+func NewDeadLetterErrorPolicy(deadLetter Daemon) ErrorPolicy {
+	return ErrorPolicyFn(func(ctx context.Context, errChan chan error, err error) error {
+		select {
+		case <-ctx.Done():
+		case deadLetter.In() <- err:
+		}
+		return nil
+	})
+}
+
+// ContextWithErrorPolicy sets the error policy for every daemon run with ctx
+// that has no policy of its own
+func ContextWithErrorPolicy(ctx context.Context, policy ErrorPolicy) context.Context {
+	return withStageSetting(ctx, func(s *stage) {
+		s.errorPolicy = policy
+	})
+}
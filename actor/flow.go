@@ -0,0 +1,131 @@
+package actor
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+// Output contract shared by daemon-wrapped and connector-wrapped actors:
+//   - Drop (or nil) skips the message, the stage keeps running;
+//   - Outputs emits every element as a separate message;
+//   - ErrorEndOfStream stops the stage after the returned output (if any) is emitted.
+
+var ErrorEndOfStream = fmt.Errorf("end of stream")
+
+type dropMessage struct{}
+
+var Drop = dropMessage{}
+
+type Outputs []interface{}
+
+type FilterFn func(ctx context.Context, in interface{}) (keep bool, err error)
+
+type FlatMapFn func(ctx context.Context, in interface{}) (outs []interface{}, err error)
+
+func (fn FilterFn) AsActorFn() ActorFn {
+	return func(ctx context.Context, in interface{}) (out interface{}, err error) {
+		keep, err := fn(ctx, in)
+		if err != nil {
+			return nil, err
+		}
+
+		if !keep {
+			return Drop, nil
+		}
+		return in, nil
+	}
+}
+
+func (fn FlatMapFn) AsActorFn() ActorFn {
+	return func(ctx context.Context, in interface{}) (out interface{}, err error) {
+		outs, err := fn(ctx, in)
+		if len(outs) == 0 {
+			return Drop, err
+		}
+
+		return Outputs(outs), err
+	}
+}
+
+func NewFilterActor(fn FilterFn) Actor {
+	return fn.AsActorFn()
+}
+
+func NewFlatMapActor(fn FlatMapFn) Actor {
+	return fn.AsActorFn()
+}
+
+func IsDropped(out interface{}) bool {
+	return out == nil || out == Drop
+}
+
+func isEndOfStream(err error) bool {
+	return errors.Is(err, ErrorEndOfStream)
+}
+
+// emit writes an actor output to out. Returns false when ctx is done.
+func emit(ctx context.Context, out chan interface{}, outData interface{}) bool {
+	if IsDropped(outData) {
+		return true
+	}
+
+	if outs, ok := outData.(Outputs); ok {
+		for _, o := range outs {
+			if !emit(ctx, out, o) {
+				return false
+			}
+		}
+		return true
+	}
+
+	// counted before the send, so the reader of the message sees it counted
+	stats := stageFromContext(ctx).stats
+	stats.emitted(1)
+
+	select {
+	case <-ctx.Done():
+		stats.emitted(-1)
+		return false
+	case out <- outData:
+		// the metric counters don't go back, so they count the sent messages only
+		observeEmitted(ctx)
+		return true
+	}
+}
+
+// callEach calls actor for every message in an actor output and
+// collects the results into a single output.
+func callEach(ctx context.Context, actor Actor, in interface{}) (out interface{}, err error) {
+	if IsDropped(in) {
+		return Drop, nil
+	}
+
+	ins, ok := in.(Outputs)
+	if !ok {
+		return actor.Call(ctx, in)
+	}
+
+	outs := make(Outputs, 0, len(ins))
+	for _, i := range ins {
+		o, err := callEach(ctx, actor, i)
+		if err != nil && !isEndOfStream(err) {
+			return nil, err
+		}
+
+		if flat, ok := o.(Outputs); ok {
+			outs = append(outs, flat...)
+		} else if !IsDropped(o) {
+			outs = append(outs, o)
+		}
+
+		if err != nil {
+			return outs, err
+		}
+	}
+
+	if len(outs) == 0 {
+		return Drop, nil
+	}
+	return outs, nil
+}
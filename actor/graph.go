@@ -0,0 +1,366 @@
+package actor
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+)
+
+var ErrorGraphNode = fmt.Errorf("bad graph node")
+var ErrorGraphEdge = fmt.Errorf("bad graph edge")
+var ErrorGraphCycle = fmt.Errorf("graph has a cycle")
+
+const (
+	// GraphInput is the node of the graph input, connect it to the nodes reading the graph input
+	GraphInput = "input"
+	// GraphOutput is the node of the graph output
+	GraphOutput = "output"
+
+	// PortIn is the input port of a node
+	PortIn = "in"
+	// PortOut is the default output port of a node
+	PortOut = "out"
+)
+
+// PortMessage is a message on a named port. A node emits it to send Data from the
+// output port Port. A node receives the messages of an input port other than
+// PortIn wrapped in it, so it can tell its inputs apart.
+type PortMessage struct {
+	Port string
+	Data interface{}
+}
+
+// Graph builds a pipeline of named nodes with arbitrary edges between them:
+// diamonds, fan-out, fan-in and side branches. Ports are written as node.port,
+// a bare node name means the PortOut or PortIn port of the node.
+//
+// An output port connected to several inputs sends a copy of every message to each of them.
+// An input connected to several outputs is closed after all of them are closed. Nodes without
+// inputs have their input closed at start, messages on ports without edges are dropped.
+type Graph interface {
+	// AddNode adds an Actor or a Daemon (connectors and clusters included)
+	AddNode(name string, node interface{}) Graph
+	// Connect connects the output port from to the input port to
+	Connect(from string, to string) Graph
+
+	AsDaemon() Daemon
+	// Run checks the graph and runs every node
+	Run(ctx context.Context) (Daemon, error)
+}
+
+type graphInstance struct {
+	opts  []DaemonOption
+	nodes map[string]Daemon
+	// node names in the order they were added
+	names []string
+	edges []graphEdge
+	errs  []error
+}
+
+type graphPort struct {
+	node string
+	port string
+}
+
+type graphEdge struct {
+	from graphPort
+	to   graphPort
+}
+
+func NewGraph(opts ...DaemonOption) Graph {
+	return &graphInstance{
+		opts:  opts,
+		nodes: make(map[string]Daemon),
+	}
+}
+
+func (g *graphInstance) AddNode(name string, node interface{}) Graph {
+	switch {
+	case name == GraphInput || name == GraphOutput || name == "" || strings.Contains(name, "."):
+		g.errs = append(g.errs, fmt.Errorf("%w: %q is not a valid name", ErrorGraphNode, name))
+		return g
+	case g.nodes[name] != nil:
+		g.errs = append(g.errs, fmt.Errorf("%w: %q is already added", ErrorGraphNode, name))
+		return g
+	}
+
+	var d Daemon
+	switch n := node.(type) {
+	case Daemon:
+		d = n.Clone()
+	case Actor:
+		d = n.AsActorFn().AsDaemon(WithName(name))
+	default:
+		g.errs = append(g.errs, fmt.Errorf("%w: %q is %T, not an Actor or a Daemon", ErrorGraphNode, name, node))
+		return g
+	}
+
+	g.nodes[name] = d
+	g.names = append(g.names, name)
+	return g
+}
+
+func (g *graphInstance) Connect(from string, to string) Graph {
+	g.edges = append(g.edges, graphEdge{
+		from: parsePort(from, PortOut),
+		to:   parsePort(to, PortIn),
+	})
+	return g
+}
+
+func parsePort(s string, defaultPort string) graphPort {
+	node, port, ok := strings.Cut(s, ".")
+	if !ok {
+		port = defaultPort
+	}
+	return graphPort{node: node, port: port}
+}
+
+func (p graphPort) String() string {
+	return p.node + "." + p.port
+}
+
+func (g *graphInstance) AsDaemon() Daemon {
+	// later changes of the builder don't change the daemon
+	g2 := &graphInstance{
+		nodes: make(map[string]Daemon, len(g.nodes)),
+		names: append([]string(nil), g.names...),
+		edges: append([]graphEdge(nil), g.edges...),
+		errs:  append([]error(nil), g.errs...),
+	}
+	for name, d := range g.nodes {
+		g2.nodes[name] = d.Clone()
+	}
+
+	return NewDaemon(g2.run, g.opts...).(*daemonPrototype).withTopology(func(t *topologyBuilder, d *daemonPrototype) *describedNode {
+		return t.describeGraph(d, g2)
+	})
+}
+
+func (g *graphInstance) Run(ctx context.Context) (Daemon, error) {
+	if err := g.validate(); err != nil {
+		return nil, err
+	}
+	return g.AsDaemon().Run(ctx)
+}
+
+// validate checks the nodes of the edges and looks for cycles
+func (g *graphInstance) validate() error {
+	errs := append([]error(nil), g.errs...)
+
+	for _, e := range g.edges {
+		if e.from.node == GraphOutput || e.from.node != GraphInput && g.nodes[e.from.node] == nil {
+			errs = append(errs, fmt.Errorf("%w %s -> %s: unknown node %q", ErrorGraphEdge, e.from, e.to, e.from.node))
+		}
+		if e.to.node == GraphInput || e.to.node != GraphOutput && g.nodes[e.to.node] == nil {
+			errs = append(errs, fmt.Errorf("%w %s -> %s: unknown node %q", ErrorGraphEdge, e.from, e.to, e.to.node))
+		}
+	}
+	if len(errs) > 0 {
+		return errors.Join(errs...)
+	}
+
+	// Kahn's algorithm: the nodes left after removing the nodes without inputs are in a cycle
+	inputs := make(map[string]int, len(g.nodes))
+	for _, e := range g.edges {
+		if g.nodes[e.from.node] != nil && g.nodes[e.to.node] != nil {
+			inputs[e.to.node]++
+		}
+	}
+
+	var ready []string
+	for _, name := range g.names {
+		if inputs[name] == 0 {
+			ready = append(ready, name)
+		}
+	}
+
+	removed := 0
+	for len(ready) > 0 {
+		name := ready[0]
+		ready = ready[1:]
+		removed++
+
+		for _, e := range g.edges {
+			if e.from.node == name && g.nodes[e.to.node] != nil {
+				inputs[e.to.node]--
+				if inputs[e.to.node] == 0 {
+					ready = append(ready, e.to.node)
+				}
+			}
+		}
+	}
+
+	if removed < len(g.names) {
+		var cycle []string
+		for _, name := range g.names {
+			if inputs[name] > 0 {
+				cycle = append(cycle, name)
+			}
+		}
+		return fmt.Errorf("%w: %s", ErrorGraphCycle, strings.Join(cycle, ", "))
+	}
+
+	return nil
+}
+
+func (g *graphInstance) run(ctx context.Context, in chan interface{}, out chan interface{}, errChan chan error) error {
+	if err := g.validate(); err != nil {
+		return err
+	}
+
+	running := make(map[string]Daemon, len(g.nodes))
+	stopped := make(map[string]chan struct{}, len(g.nodes))
+
+	for _, name := range g.names {
+		d := g.nodes[name].Clone()
+		if d.Err() == nil {
+			d.SetErr(errChan)
+		}
+
+		r, err := d.Run(ctx)
+		if err != nil {
+			for _, r := range running {
+				r.Stop()
+				r.Wait()
+			}
+			return err
+		}
+
+		running[name] = r
+		stopped[name] = make(chan struct{})
+		go func(r Daemon, stopped chan struct{}) {
+			r.Wait()
+			close(stopped)
+		}(r, stopped[name])
+	}
+
+	// the edges of every output port and the number of nodes writing to every input
+	ports := make(map[string]map[string][]graphPort)
+	targets := make(map[string]map[string]bool)
+	upstreams := make(map[string]int)
+
+	for _, e := range g.edges {
+		if ports[e.from.node] == nil {
+			ports[e.from.node] = make(map[string][]graphPort)
+			targets[e.from.node] = make(map[string]bool)
+		}
+		ports[e.from.node][e.from.port] = append(ports[e.from.node][e.from.port], e.to)
+
+		if !targets[e.from.node][e.to.node] {
+			targets[e.from.node][e.to.node] = true
+			upstreams[e.to.node]++
+		}
+	}
+
+	mu := sync.Mutex{}
+	release := func(source string) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		for target := range targets[source] {
+			upstreams[target]--
+			if upstreams[target] == 0 && target != GraphOutput {
+				closeDaemonIn(running[target])
+			}
+		}
+	}
+
+	for _, name := range g.names {
+		if upstreams[name] == 0 {
+			closeDaemonIn(running[name])
+		}
+	}
+
+	send := func(source string, msg interface{}) bool {
+		port := PortOut
+		if m, ok := msg.(PortMessage); ok {
+			port, msg = m.Port, m.Data
+		}
+
+		for _, to := range ports[source][port] {
+			data := msg
+			if to.port != PortIn {
+				data = PortMessage{Port: to.port, Data: msg}
+			}
+
+			target := out
+			if to.node != GraphOutput {
+				target = running[to.node].In()
+			}
+
+			select {
+			case <-ctx.Done():
+				return false
+			case <-stopped[to.node]:
+				// the node has already failed or ended the stream
+			case target <- data:
+			}
+		}
+		return true
+	}
+
+	wg := &sync.WaitGroup{}
+	for _, name := range g.names {
+		wg.Add(1)
+		go func(name string) {
+			defer wg.Done()
+			defer release(name)
+
+			readOutput(ctx, running[name], func(msg interface{}) bool {
+				return send(name, msg)
+			})
+		}(name)
+	}
+
+	if targets[GraphInput] != nil {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer release(GraphInput)
+
+			g.readInput(ctx, in, targets[GraphInput], stopped, func(msg interface{}) bool {
+				return send(GraphInput, msg)
+			})
+		}()
+	}
+
+	wg.Wait()
+
+	var errs []error
+	for _, name := range g.names {
+		errs = append(errs, running[name].WaitErr())
+	}
+
+	return childErrors(errs...)
+}
+
+// readInput passes the graph input to fn until the input is closed,
+// fn returns false or every node reading the input stops
+func (g *graphInstance) readInput(ctx context.Context, in chan interface{}, targets map[string]bool, stopped map[string]chan struct{}, fn func(msg interface{}) bool) {
+	targetsStopped := make(chan struct{})
+	if !targets[GraphOutput] {
+		go func() {
+			for target := range targets {
+				<-stopped[target]
+			}
+			close(targetsStopped)
+		}()
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-targetsStopped:
+			return
+
+		case msg, ok := <-in:
+			if !ok || !fn(msg) {
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,66 @@
+package actor
+
+import (
+	"hash/fnv"
+	"sort"
+	"strconv"
+)
+
+// virtual nodes per worker, spread the keys evenly over the workers
+const hashRingReplicas = 64
+
+type hashRingPoint struct {
+	hash uint64
+	id   int
+}
+
+// hashRing is a consistent hash ring: adding or removing a worker moves
+// only the keys of that worker.
+type hashRing struct {
+	points []hashRingPoint
+}
+
+func (r *hashRing) add(id int) {
+	for i := 0; i < hashRingReplicas; i++ {
+		r.points = append(r.points, hashRingPoint{
+			hash: hashKey(strconv.Itoa(id) + "#" + strconv.Itoa(i)),
+			id:   id,
+		})
+	}
+
+	sort.Slice(r.points, func(i, j int) bool {
+		return r.points[i].hash < r.points[j].hash
+	})
+}
+
+func (r *hashRing) remove(id int) {
+	points := r.points[:0]
+	for _, p := range r.points {
+		if p.id != id {
+			points = append(points, p)
+		}
+	}
+	r.points = points
+}
+
+// get returns the worker of the key, -1 when the ring is empty
+func (r *hashRing) get(key string) int {
+	if len(r.points) == 0 {
+		return -1
+	}
+
+	h := hashKey(key)
+	i := sort.Search(len(r.points), func(i int) bool {
+		return r.points[i].hash >= h
+	})
+	if i == len(r.points) {
+		i = 0
+	}
+	return r.points[i].id
+}
+
+func hashKey(key string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	return h.Sum64()
+}
@@ -2,7 +2,9 @@ package actor
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
+	"log/slog"
 	"strconv"
 	"sync/atomic"
 
@@ -19,9 +21,16 @@ const (
 	logPrefix     = "row-"
 )
 
+// logRecord is a logged enveloped message. Messages without envelope are logged as they are.
+type logRecord struct {
+	Envelope *Envelope       `json:"__envelope"`
+	Payload  json.RawMessage `json:"payload"`
+}
+
 type LogActor struct {
 	logPath       string
 	disabledWrite bool
+	logger        *slog.Logger
 	db            *leveldb.DB
 }
 
@@ -49,28 +58,44 @@ func (l *LogActor) SetDisabledWrite(disabledWrite bool) {
 	l.disabledWrite = disabledWrite
 }
 
-// in: nothing out: interface{} from createStruct
+// SetLogger sets the logger of the restore daemon
+func (l *LogActor) SetLogger(logger *slog.Logger) {
+	l.logger = logger
+}
+
+// in: nothing out: interface{} from createStruct, *Envelope with it for the enveloped messages
 func (l *LogActor) LogRestoreDaemon(createStruct func() interface{}) Daemon {
 	return NewDaemon(func(ctx context.Context, in chan interface{}, out chan interface{}, errChan chan error) error {
 		iter := l.db.NewIterator(util.BytesPrefix([]byte(logPrefix)), nil)
 		defer iter.Release()
 		for iter.Next() {
 			logJson := iter.Value()
+
+			var record logRecord
+			if json.Unmarshal(logJson, &record) == nil && record.Envelope != nil {
+				logJson = record.Payload
+			}
+
 			row := createStruct()
 
 			if err := json.Unmarshal(logJson, row); err != nil {
-				select {
-				case <-ctx.Done():
-					return nil
-				case errChan <- fmt.Errorf("error unmarshal data: %w", err):
-					fmt.Println("ERR marshal:", err)
+				// the half-filled row is skipped, the key of the row is the input of the error
+				err = newStageError(StageName(ctx), string(iter.Key()), fmt.Errorf("error unmarshal data: %w", err))
+				if err = reportError(ctx, errChan, err); err != nil {
+					return err
 				}
+				continue
+			}
+
+			var msg interface{} = row
+			if record.Envelope != nil {
+				msg = record.Envelope.WithPayload(row)
 			}
 
 			select {
 			case <-ctx.Done():
 				return nil
-			case out <- row:
+			case out <- msg:
 			}
 		}
 
@@ -79,7 +104,7 @@ func (l *LogActor) LogRestoreDaemon(createStruct func() interface{}) Daemon {
 		}
 
 		return nil
-	})
+	}, WithLogger(l.logger))
 }
 
 func (l *LogActor) LogActor() (Actor, error) {
@@ -108,6 +133,13 @@ func (l *LogActor) LogActor() (Actor, error) {
 			return in, err
 		}
 
+		if e := EnvelopeFromContext(ctx); e != nil {
+			inJson, err = json.Marshal(logRecord{Envelope: e, Payload: inJson})
+			if err != nil {
+				return in, err
+			}
+		}
+
 		err = l.db.Put([]byte(logPrefix+strconv.FormatUint(currentRowId, 10)), inJson, nil)
 		if err != nil {
 			return in, err
@@ -0,0 +1,79 @@
+package actor
+
+import (
+	"context"
+	"log/slog"
+)
+
+// ContextWithLogger is the logger of the daemons run with ctx without WithLogger
+func ContextWithLogger(ctx context.Context, logger *slog.Logger) context.Context {
+	return withStageSetting(ctx, func(s *stage) {
+		s.logger = logger
+	})
+}
+
+// Logger returns the logger of the current stage with its name, the cluster worker ID
+// and the envelope ID of the current message. Without a logger the records are discarded.
+func Logger(ctx context.Context) *slog.Logger {
+	if logger := stageLogger(ctx); logger != nil {
+		return logger
+	}
+	return slog.New(discardHandler{})
+}
+
+// stageLogger works like Logger but returns nil when the stage has no logger
+func stageLogger(ctx context.Context) *slog.Logger {
+	s := stageFromContext(ctx)
+	if s.logger == nil {
+		return nil
+	}
+	return withStageAttrs(ctx, s.logger)
+}
+
+// withStageAttrs adds the stage name, the worker ID and the envelope ID to logger
+func withStageAttrs(ctx context.Context, logger *slog.Logger) *slog.Logger {
+	s := stageFromContext(ctx)
+	if s.name != "" {
+		logger = logger.With("stage", s.name)
+	}
+	if id := WorkerID(ctx); id >= 0 {
+		logger = logger.With("worker", id)
+	}
+	if e := EnvelopeFromContext(ctx); e != nil {
+		logger = logger.With("message", e.ID)
+	}
+	return logger
+}
+
+// logStatus logs the lifecycle transition of the running daemon
+func (d *daemonPrototype) logStatus(status Status, err error) {
+	ctx := d.state.ctx
+
+	logger := stageLogger(ctx)
+	if logger == nil {
+		return
+	}
+	if d.opts.name == "" {
+		logger = logger.With("stage", d.stageName())
+	}
+
+	switch status {
+	case StatusFailed:
+		logger.Error("daemon failed", "err", err)
+	case StatusStopped:
+		if cause := context.Cause(ctx); cause != nil {
+			logger.Debug("daemon stopped", "cause", cause)
+		} else {
+			logger.Debug("daemon stopped")
+		}
+	default:
+		logger.Debug("daemon " + status.String())
+	}
+}
+
+type discardHandler struct{}
+
+func (discardHandler) Enabled(context.Context, slog.Level) bool  { return false }
+func (discardHandler) Handle(context.Context, slog.Record) error { return nil }
+func (h discardHandler) WithAttrs([]slog.Attr) slog.Handler      { return h }
+func (h discardHandler) WithGroup(string) slog.Handler           { return h }
@@ -0,0 +1,136 @@
+package actor
+
+import (
+	"context"
+	"sync"
+)
+
+// NewMergeDaemon runs the upstream daemons and writes their outputs to its output.
+// The merge input is one more upstream, so the merge can be connected after another
+// stage; closing the input closes the upstream inputs too. The output is closed after
+// every upstream has stopped and the input is closed. Stop stops every upstream and
+// Wait waits for them.
+func NewMergeDaemon(daemons ...Daemon) Daemon {
+	return NewMergeDaemonWithOptions(daemons)
+}
+
+// NewMergeDaemonWithOptions works like NewMergeDaemon with the options of the merge daemon
+func NewMergeDaemonWithOptions(daemons []Daemon, opts ...DaemonOption) Daemon {
+	fn := DaemonFn(func(ctx context.Context, in chan interface{}, out chan interface{}, errChan chan error) error {
+		upstreams := make([]Daemon, 0, len(daemons))
+
+		for _, d := range daemons {
+			u := d.Clone()
+			if !u.IsLaunched() {
+				if u.Err() == nil {
+					u.SetErr(errChan)
+				}
+
+				var err error
+				if u, err = u.Run(ctx); err != nil {
+					for _, u := range upstreams {
+						u.Stop()
+						u.Wait()
+					}
+					return err
+				}
+			}
+			upstreams = append(upstreams, u)
+		}
+
+		wg := &sync.WaitGroup{}
+		for _, u := range upstreams {
+			wg.Add(1)
+			go func(u Daemon) {
+				defer wg.Done()
+				mergeOutput(ctx, u, out)
+			}(u)
+		}
+
+		merged := make(chan struct{})
+		go func() {
+			wg.Wait()
+			close(merged)
+		}()
+
+		// the merge stops when every upstream has stopped and its own input is closed
+		merging, done, input := merged, ctx.Done(), in
+		for merging != nil || input != nil {
+			select {
+			case <-merging:
+				merging = nil
+
+			case <-done:
+				// upstreams launched before the merge don't share its context
+				for _, u := range upstreams {
+					u.Stop()
+				}
+				done, input = nil, nil
+
+			case inData, ok := <-input:
+				if !ok {
+					for _, u := range upstreams {
+						closeDaemonIn(u)
+					}
+					input = nil
+					continue
+				}
+				emit(ctx, out, inData)
+			}
+		}
+
+		var errs []error
+		for _, u := range upstreams {
+			errs = append(errs, u.WaitErr())
+		}
+
+		return childErrors(errs...)
+	})
+
+	return NewDaemon(fn, opts...).(*daemonPrototype).withTopology(func(t *topologyBuilder, d *daemonPrototype) *describedNode {
+		return t.describeMerge(d, daemons)
+	})
+}
+
+// mergeOutput writes the output of the upstream to out until the upstream stops
+func mergeOutput(ctx context.Context, u Daemon, out chan interface{}) {
+	readOutput(ctx, u, func(msg interface{}) bool {
+		return emit(ctx, out, msg)
+	})
+}
+
+// readOutput passes the output of the daemon to fn until the output is closed,
+// the daemon stops or fn returns false
+func readOutput(ctx context.Context, d Daemon, fn func(msg interface{}) bool) {
+	stopped := make(chan struct{})
+	go func() {
+		d.Wait()
+		close(stopped)
+	}()
+
+	out := d.Out()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+
+		case msg, ok := <-out:
+			if !ok || !fn(msg) {
+				return
+			}
+
+		case <-stopped:
+			// the daemon doesn't close its output, take what is left in the buffer
+			for {
+				select {
+				case msg, ok := <-out:
+					if !ok || !fn(msg) {
+						return
+					}
+				default:
+					return
+				}
+			}
+		}
+	}
+}
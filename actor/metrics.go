@@ -0,0 +1,297 @@
+package actor
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Metrics receives the measurements of the stages. The registry of NewMetricsRegistry
+// exposes them for Prometheus, implement Metrics to send them to another backend.
+// The worker of a cluster stage is WorkerID(ctx).
+type Metrics interface {
+	// ObserveCall is called after every actor call, err is nil for the processed messages.
+	// The failed calls are passed to ObserveError as well when the actor reports them.
+	ObserveCall(ctx context.Context, stage string, duration time.Duration, err error)
+	// ObserveReceived is called for every message the stage takes from its input
+	ObserveReceived(ctx context.Context, stage string)
+	// ObserveEmitted is called for every message the stage passes to its output
+	ObserveEmitted(ctx context.Context, stage string)
+	// ObserveError is called for every error the stage passes to its error policy
+	ObserveError(ctx context.Context, stage string, err error)
+	// ObserveChannels is called with the occupancy of the stage channels when it takes a message
+	ObserveChannels(ctx context.Context, stage string, inLen, inCap, outLen, outCap int)
+}
+
+// MetricsRegistry collects the stage metrics and serves them in the Prometheus text format
+type MetricsRegistry interface {
+	Metrics
+	http.Handler
+
+	// WriteText writes the metrics in the Prometheus text format
+	WriteText(w io.Writer) error
+}
+
+// DefaultLatencyBuckets are the upper bounds of the call latency histogram in seconds
+var DefaultLatencyBuckets = []float64{0.0001, 0.0005, 0.001, 0.005, 0.01, 0.05, 0.1, 0.5, 1, 5}
+
+type metricsRegistryInstance struct {
+	buckets []float64
+
+	mu     sync.Mutex
+	stages map[stageMetricsKey]*stageMetrics
+}
+
+type stageMetricsKey struct {
+	stage  string
+	worker int
+}
+
+type stageMetrics struct {
+	received  uint64
+	emitted   uint64
+	processed uint64
+	failed    uint64
+
+	// calls with the latency up to every bucket bound, not cumulative
+	buckets  []uint64
+	count    uint64
+	duration float64
+
+	inLen, inCap   int
+	outLen, outCap int
+	channels       bool
+}
+
+// NewMetricsRegistry returns a registry with the latency histogram buckets,
+// DefaultLatencyBuckets when there are none
+func NewMetricsRegistry(buckets ...float64) MetricsRegistry {
+	if len(buckets) == 0 {
+		buckets = DefaultLatencyBuckets
+	}
+	buckets = append([]float64(nil), buckets...)
+	sort.Float64s(buckets)
+
+	return &metricsRegistryInstance{
+		buckets: buckets,
+		stages:  make(map[stageMetricsKey]*stageMetrics),
+	}
+}
+
+func (r *metricsRegistryInstance) stage(ctx context.Context, stage string) *stageMetrics {
+	key := stageMetricsKey{stage: stage, worker: WorkerID(ctx)}
+
+	m, ok := r.stages[key]
+	if !ok {
+		m = &stageMetrics{buckets: make([]uint64, len(r.buckets))}
+		r.stages[key] = m
+	}
+	return m
+}
+
+func (r *metricsRegistryInstance) ObserveCall(ctx context.Context, stage string, duration time.Duration, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	m := r.stage(ctx, stage)
+	if err == nil {
+		m.processed++
+	}
+
+	seconds := duration.Seconds()
+	m.count++
+	m.duration += seconds
+	if i := sort.SearchFloat64s(r.buckets, seconds); i < len(r.buckets) {
+		m.buckets[i]++
+	}
+}
+
+func (r *metricsRegistryInstance) ObserveReceived(ctx context.Context, stage string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.stage(ctx, stage).received++
+}
+
+func (r *metricsRegistryInstance) ObserveEmitted(ctx context.Context, stage string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.stage(ctx, stage).emitted++
+}
+
+func (r *metricsRegistryInstance) ObserveError(ctx context.Context, stage string, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.stage(ctx, stage).failed++
+}
+
+func (r *metricsRegistryInstance) ObserveChannels(ctx context.Context, stage string, inLen, inCap, outLen, outCap int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	m := r.stage(ctx, stage)
+	m.inLen, m.inCap = inLen, inCap
+	m.outLen, m.outCap = outLen, outCap
+	m.channels = true
+}
+
+func (r *metricsRegistryInstance) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	r.WriteText(w)
+}
+
+func (r *metricsRegistryInstance) WriteText(w io.Writer) error {
+	r.mu.Lock()
+	keys := make([]stageMetricsKey, 0, len(r.stages))
+	stages := make(map[stageMetricsKey]stageMetrics, len(r.stages))
+	for key, m := range r.stages {
+		keys = append(keys, key)
+		copied := *m
+		copied.buckets = append([]uint64(nil), m.buckets...)
+		stages[key] = copied
+	}
+	r.mu.Unlock()
+
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].stage != keys[j].stage {
+			return keys[i].stage < keys[j].stage
+		}
+		return keys[i].worker < keys[j].worker
+	})
+
+	b := &strings.Builder{}
+
+	b.WriteString("# HELP actor_messages_received_total Messages the stage took from its input.\n")
+	b.WriteString("# TYPE actor_messages_received_total counter\n")
+	for _, key := range keys {
+		fmt.Fprintf(b, "actor_messages_received_total{%s} %d\n", key.labels(), stages[key].received)
+	}
+
+	b.WriteString("# HELP actor_messages_emitted_total Messages the stage passed to its output.\n")
+	b.WriteString("# TYPE actor_messages_emitted_total counter\n")
+	for _, key := range keys {
+		fmt.Fprintf(b, "actor_messages_emitted_total{%s} %d\n", key.labels(), stages[key].emitted)
+	}
+
+	b.WriteString("# HELP actor_messages_processed_total Messages processed by the stage.\n")
+	b.WriteString("# TYPE actor_messages_processed_total counter\n")
+	for _, key := range keys {
+		fmt.Fprintf(b, "actor_messages_processed_total{%s} %d\n", key.labels(), stages[key].processed)
+	}
+
+	b.WriteString("# HELP actor_messages_failed_total Errors the stage reported.\n")
+	b.WriteString("# TYPE actor_messages_failed_total counter\n")
+	for _, key := range keys {
+		fmt.Fprintf(b, "actor_messages_failed_total{%s} %d\n", key.labels(), stages[key].failed)
+	}
+
+	b.WriteString("# HELP actor_call_duration_seconds Latency of the actor calls.\n")
+	b.WriteString("# TYPE actor_call_duration_seconds histogram\n")
+	for _, key := range keys {
+		m := stages[key]
+		var cumulative uint64
+		for i, bound := range r.buckets {
+			cumulative += m.buckets[i]
+			fmt.Fprintf(b, "actor_call_duration_seconds_bucket{%s,le=%q} %d\n", key.labels(), formatFloat(bound), cumulative)
+		}
+		fmt.Fprintf(b, "actor_call_duration_seconds_bucket{%s,le=\"+Inf\"} %d\n", key.labels(), m.count)
+		fmt.Fprintf(b, "actor_call_duration_seconds_sum{%s} %s\n", key.labels(), formatFloat(m.duration))
+		fmt.Fprintf(b, "actor_call_duration_seconds_count{%s} %d\n", key.labels(), m.count)
+	}
+
+	b.WriteString("# HELP actor_channel_length Messages in the stage channel.\n")
+	b.WriteString("# TYPE actor_channel_length gauge\n")
+	for _, key := range keys {
+		if m := stages[key]; m.channels {
+			fmt.Fprintf(b, "actor_channel_length{%s,channel=\"in\"} %d\n", key.labels(), m.inLen)
+			fmt.Fprintf(b, "actor_channel_length{%s,channel=\"out\"} %d\n", key.labels(), m.outLen)
+		}
+	}
+
+	b.WriteString("# HELP actor_channel_capacity Capacity of the stage channel.\n")
+	b.WriteString("# TYPE actor_channel_capacity gauge\n")
+	for _, key := range keys {
+		if m := stages[key]; m.channels {
+			fmt.Fprintf(b, "actor_channel_capacity{%s,channel=\"in\"} %d\n", key.labels(), m.inCap)
+			fmt.Fprintf(b, "actor_channel_capacity{%s,channel=\"out\"} %d\n", key.labels(), m.outCap)
+		}
+	}
+
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+func (k stageMetricsKey) labels() string {
+	labels := "stage=" + quoteLabel(k.stage)
+	if k.worker >= 0 {
+		labels += ",worker=" + quoteLabel(strconv.Itoa(k.worker))
+	}
+	return labels
+}
+
+// quoteLabel quotes a label value as the Prometheus text format expects
+func quoteLabel(s string) string {
+	s = strings.ReplaceAll(s, `\`, `\\`)
+	s = strings.ReplaceAll(s, "\n", `\n`)
+	return `"` + strings.ReplaceAll(s, `"`, `\"`) + `"`
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+// ContextWithMetrics is the default of WithMetrics for the daemons run with ctx
+func ContextWithMetrics(ctx context.Context, metrics Metrics) context.Context {
+	return withStageSetting(ctx, func(s *stage) {
+		s.metrics = metrics
+	})
+}
+
+// observeCall passes the actor call started at start to the metrics of the stage
+func observeCall(ctx context.Context, stage string, start time.Time, err error) {
+	if m := stageFromContext(ctx).metrics; m != nil {
+		if isEndOfStream(err) {
+			err = nil
+		}
+		m.ObserveCall(ctx, stage, time.Since(start), err)
+	}
+}
+
+// withMetricsLabel labels the metrics of the current stage with name
+func withMetricsLabel(ctx context.Context, name string) context.Context {
+	return withStageSetting(ctx, func(s *stage) {
+		s.label = name
+	})
+}
+
+func observeReceived(ctx context.Context) {
+	if s := stageFromContext(ctx); s.metrics != nil {
+		s.metrics.ObserveReceived(ctx, s.label)
+	}
+}
+
+func observeEmitted(ctx context.Context) {
+	if s := stageFromContext(ctx); s.metrics != nil {
+		s.metrics.ObserveEmitted(ctx, s.label)
+	}
+}
+
+func observeError(ctx context.Context, err error) {
+	if s := stageFromContext(ctx); s.metrics != nil {
+		s.metrics.ObserveError(ctx, s.label, err)
+	}
+}
+
+func observeChannels(ctx context.Context, stage string, in chan interface{}, out chan interface{}) {
+	if m := stageFromContext(ctx).metrics; m != nil {
+		m.ObserveChannels(ctx, stage, len(in), cap(in), len(out), cap(out))
+	}
+}
@@ -0,0 +1,66 @@
+package actor
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"runtime"
+	"runtime/debug"
+)
+
+// PanicError is reported instead of crashing the process when an ActorFn or
+// DaemonFn panics. Input is nil when the panic happened outside of an ActorFn
+// call (e.g. in a DaemonFn loop).
+type PanicError struct {
+	Stage string
+	Input interface{}
+	Value interface{}
+	Stack []byte
+}
+
+func (e *PanicError) Error() string {
+	return fmt.Sprintf("panic in stage %s: %v", e.Stage, e.Value)
+}
+
+func (e *PanicError) Unwrap() error {
+	if err, ok := e.Value.(error); ok {
+		return err
+	}
+	return nil
+}
+
+func newPanicError(stage string, input interface{}, value interface{}) *PanicError {
+	return &PanicError{
+		Stage: stage,
+		Input: input,
+		Value: value,
+		Stack: debug.Stack(),
+	}
+}
+
+func (fn ActorFn) safeCall(ctx context.Context, stage string, in interface{}) (out interface{}, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			out, err = nil, newPanicError(stage, in, r)
+		}
+	}()
+
+	return fn(ctx, in)
+}
+
+func (fn DaemonFn) safeRun(ctx context.Context, stage string, in chan interface{}, out chan interface{}, errChan chan error) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = newPanicError(stage, nil, r)
+		}
+	}()
+
+	return fn(ctx, in, out, errChan)
+}
+
+func funcName(fn interface{}) string {
+	if f := runtime.FuncForPC(reflect.ValueOf(fn).Pointer()); f != nil {
+		return f.Name()
+	}
+	return "unknown"
+}
@@ -0,0 +1,138 @@
+package actor
+
+import (
+	"context"
+	"fmt"
+)
+
+var ErrorNoRoute = fmt.Errorf("no route")
+
+// DefaultBranch is the router branch for the messages that match no other branch
+const DefaultBranch = "default"
+
+// RouteFn returns the name of the router branch for the message. It gets the payload
+// of an enveloped message, the envelope is in EnvelopeFromContext(ctx).
+type RouteFn func(ctx context.Context, msg interface{}) (branch string, err error)
+
+// RoutePredicate sends the messages it matches to the branch
+type RoutePredicate struct {
+	Branch string
+	Match  func(msg interface{}) bool
+}
+
+// RouteFirst returns a RouteFn that picks the branch of the first matching predicate
+func RouteFirst(predicates ...RoutePredicate) RouteFn {
+	return func(ctx context.Context, msg interface{}) (string, error) {
+		for _, p := range predicates {
+			if p.Match(msg) {
+				return p.Branch, nil
+			}
+		}
+		return DefaultBranch, nil
+	}
+}
+
+// NewRouter sends every message to one of the named branches picked by route.
+// Messages for unknown branches go to DefaultBranch, ErrorNoRoute is reported
+// when there is no default branch. The branches are run with the router: branches
+// without their own output write to the router output, Stop and Wait reach every branch.
+func NewRouter(route RouteFn, branches map[string]Daemon, opts ...DaemonOption) Daemon {
+	fn := DaemonFn(func(ctx context.Context, in chan interface{}, out chan interface{}, errChan chan error) error {
+		stage := StageName(ctx)
+		if stage == "" {
+			stage = funcName(route)
+		}
+
+		running := make(map[string]Daemon, len(branches))
+		stopped := make(map[string]chan struct{}, len(branches))
+
+		for name, branch := range branches {
+			d := branch.Clone()
+			if d.Out() == nil {
+				d.DisableCloseChannelsOnStop(true)
+				d.SetOut(out)
+			}
+			if d.Err() == nil {
+				d.SetErr(errChan)
+			}
+
+			r, err := d.Run(ctx)
+			if err != nil {
+				for _, r := range running {
+					r.Stop()
+					r.Wait()
+				}
+				return err
+			}
+
+			running[name] = r
+			stopped[name] = make(chan struct{})
+			go func(r Daemon, stopped chan struct{}) {
+				r.Wait()
+				close(stopped)
+			}(r, stopped[name])
+		}
+
+		err := routeMessages(ctx, stage, route, in, errChan, running, stopped)
+
+		var errs []error
+		for _, r := range running {
+			closeDaemonIn(r)
+		}
+		for _, r := range running {
+			errs = append(errs, r.WaitErr())
+		}
+
+		if err != nil {
+			return err
+		}
+		return childErrors(errs...)
+	})
+
+	return NewDaemon(fn, opts...).(*daemonPrototype).withTopology(func(t *topologyBuilder, d *daemonPrototype) *describedNode {
+		return t.describeRouter(d, branches)
+	})
+}
+
+func routeMessages(ctx context.Context, stage string, route RouteFn, in chan interface{}, errChan chan error, running map[string]Daemon, stopped map[string]chan struct{}) error {
+	call := ActorFn(func(ctx context.Context, msg interface{}) (interface{}, error) {
+		ctx, msg, _ = openEnvelope(ctx, msg)
+		return route(ctx, msg)
+	})
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+
+		case msg, ok := <-in:
+			if !ok {
+				return nil
+			}
+
+			name, err := call.safeCall(ctx, stage, msg)
+			branch, _ := name.(string)
+			if _, ok := running[branch]; !ok && err == nil {
+				branch = DefaultBranch
+				if _, ok := running[branch]; !ok {
+					err = ErrorNoRoute
+				}
+			}
+
+			if err != nil {
+				if err = reportError(ctx, errChan, newStageError(stage, msg, err)); err != nil {
+					return err
+				}
+				continue
+			}
+
+			select {
+			case <-ctx.Done():
+				return nil
+			case <-stopped[branch]:
+				// the branch has already failed or ended the stream
+			case running[branch].In() <- msg:
+			}
+		}
+	}
+}
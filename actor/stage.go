@@ -0,0 +1,146 @@
+package actor
+
+import (
+	"context"
+	"log/slog"
+)
+
+type stageContextKey struct{}
+type pipelineContextKey struct{}
+type supervisedContextKey struct{}
+type workerContextKey struct{}
+
+// Stage settings of the running daemon, passed to its DaemonFn through the context
+type stage struct {
+	name        string
+	errorPolicy ErrorPolicy
+	metrics     Metrics
+	spans       SpanExporter
+	logger      *slog.Logger
+	// labels the metrics of the daemon, the function name of an unnamed one. Not inherited.
+	label string
+	// counters of the daemon, not inherited
+	stats *daemonStats
+	// the supervisor reports the daemon failure, the daemon doesn't
+	supervised bool
+}
+
+var defaultStage = &stage{
+	errorPolicy: ErrorPolicyBlock,
+}
+
+// newStage builds the settings of a daemon started with ctx.
+// Unset settings are inherited from the enclosing stage.
+func newStage(ctx context.Context, opts daemonOptions) *stage {
+	parent := stageFromContext(ctx)
+
+	supervised, _ := ctx.Value(supervisedContextKey{}).(bool)
+
+	s := &stage{
+		name:        opts.name,
+		errorPolicy: opts.errorPolicy,
+		metrics:     opts.metrics,
+		spans:       opts.spans,
+		logger:      opts.logger,
+		supervised:  supervised,
+	}
+	if s.errorPolicy == nil {
+		s.errorPolicy = parent.errorPolicy
+	}
+	if s.metrics == nil {
+		s.metrics = parent.metrics
+	}
+	if s.spans == nil {
+		s.spans = parent.spans
+	}
+	if s.logger == nil {
+		s.logger = parent.logger
+	}
+
+	return s
+}
+
+// withStageSetting returns ctx with a copy of the current stage changed by set,
+// the daemons run with ctx inherit the settings they don't have
+func withStageSetting(ctx context.Context, set func(s *stage)) context.Context {
+	s := *stageFromContext(ctx)
+	set(&s)
+	return withStage(ctx, &s)
+}
+
+func withStage(ctx context.Context, s *stage) context.Context {
+	if s.supervised {
+		ctx = withSupervised(ctx, false)
+	}
+	return context.WithValue(ctx, stageContextKey{}, s)
+}
+
+func withSupervised(ctx context.Context, supervised bool) context.Context {
+	return context.WithValue(ctx, supervisedContextKey{}, supervised)
+}
+
+func stageFromContext(ctx context.Context) *stage {
+	if ctx != nil {
+		if s, ok := ctx.Value(stageContextKey{}).(*stage); ok {
+			return s
+		}
+	}
+	return defaultStage
+}
+
+// StageName returns the name of the daemon running the current DaemonFn or ActorFn
+func StageName(ctx context.Context) string {
+	return stageFromContext(ctx).name
+}
+
+// Cluster worker running the current DaemonFn
+type worker struct {
+	cluster string
+	id      int
+}
+
+func withWorker(ctx context.Context, cluster string, id int) context.Context {
+	return context.WithValue(ctx, workerContextKey{}, worker{cluster: cluster, id: id})
+}
+
+// WorkerID returns the ID of the cluster worker running the current DaemonFn or ActorFn,
+// -1 outside of a cluster
+func WorkerID(ctx context.Context) int {
+	if w, ok := ctx.Value(workerContextKey{}).(worker); ok {
+		return w.id
+	}
+	return -1
+}
+
+// ClusterName returns the name of the cluster the current worker belongs to
+func ClusterName(ctx context.Context) string {
+	w, _ := ctx.Value(workerContextKey{}).(worker)
+	return w.cluster
+}
+
+// reportError passes err to the error policy of the current stage
+func reportError(ctx context.Context, errChan chan error, err error) error {
+	stageFromContext(ctx).stats.failed(err)
+	observeError(ctx, err)
+	if logger := stageLogger(ctx); logger != nil {
+		logger.Warn("stage error", "err", err)
+	}
+	return stageFromContext(ctx).errorPolicy.HandleError(ctx, errChan, err)
+}
+
+// withPipeline makes ctx cancellable by any stage started with it.
+// Returns a nil cancel when ctx already belongs to a pipeline.
+func withPipeline(ctx context.Context) (context.Context, context.CancelCauseFunc) {
+	if _, ok := ctx.Value(pipelineContextKey{}).(context.CancelCauseFunc); ok {
+		return ctx, nil
+	}
+
+	ctx, cancel := context.WithCancelCause(ctx)
+	return context.WithValue(ctx, pipelineContextKey{}, cancel), cancel
+}
+
+func cancelPipeline(ctx context.Context, cause error) {
+	if cancel, ok := ctx.Value(pipelineContextKey{}).(context.CancelCauseFunc); ok {
+		cancel(cause)
+	}
+}
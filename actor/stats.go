@@ -0,0 +1,232 @@
+package actor
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Stats is a snapshot of a daemon. MessagesIn counts the messages the actor daemons
+// and the clusters take, MessagesOut the messages the stages emit. Errors counts the
+// errors the stage reported, whatever its error policy did with them.
+type Stats struct {
+	Name   string
+	Status Status
+
+	MessagesIn  uint64
+	MessagesOut uint64
+	Errors      uint64
+	LastError   error
+
+	InLen int
+	InCap int
+	// InFlight is the number of actor calls running now
+	InFlight int
+	// Uptime is the time since Run, up to the stop of a stopped daemon
+	Uptime time.Duration
+
+	// Stages of a connector from left to right
+	Stages []Stats
+	// Workers of a running cluster
+	Workers []Stats
+}
+
+// Counters of a running daemon, updated by its stage
+type daemonStats struct {
+	in       uint64
+	out      uint64
+	errors   uint64
+	inFlight int64
+
+	mu        sync.Mutex
+	lastError error
+	// adds the stats of the inner stages, set by the DaemonFn
+	inner func(stats *Stats)
+}
+
+// The counters are updated through the stage of the context, which has no
+// counters outside of a daemon, so the methods accept a nil receiver.
+
+func (s *daemonStats) received() {
+	if s != nil {
+		atomic.AddUint64(&s.in, 1)
+	}
+}
+
+func (s *daemonStats) emitted(delta int64) {
+	if s != nil {
+		atomic.AddUint64(&s.out, uint64(delta))
+	}
+}
+
+func (s *daemonStats) called(delta int64) {
+	if s != nil {
+		atomic.AddInt64(&s.inFlight, delta)
+	}
+}
+
+func (s *daemonStats) failed(err error) {
+	if s != nil {
+		atomic.AddUint64(&s.errors, 1)
+		s.setLastError(err)
+	}
+}
+
+func (s *daemonStats) setLastError(err error) {
+	if s == nil {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.lastError = err
+}
+
+// setInner makes the stats of the daemon add the stats of the stages it runs
+func (s *daemonStats) setInner(inner func(stats *Stats)) {
+	if s == nil {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.inner = inner
+}
+
+func (s *daemonStats) addInner(stats *Stats) {
+	if s == nil {
+		return
+	}
+
+	s.mu.Lock()
+	inner := s.inner
+	s.mu.Unlock()
+
+	if inner != nil {
+		inner(stats)
+	}
+}
+
+func (s *daemonStats) fill(stats *Stats) {
+	if s == nil {
+		return
+	}
+
+	stats.MessagesIn = atomic.LoadUint64(&s.in)
+	stats.MessagesOut = atomic.LoadUint64(&s.out)
+	stats.Errors = atomic.LoadUint64(&s.errors)
+	stats.InFlight = int(atomic.LoadInt64(&s.inFlight))
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stats.LastError = s.lastError
+}
+
+func (d *daemonPrototype) Stats() Stats {
+	stats, counters := d.ownStats()
+	// the inner stages are asked without the lock of the daemon
+	counters.addInner(&stats)
+
+	return stats
+}
+
+func (d *daemonPrototype) ownStats() (Stats, *daemonStats) {
+	d.state.mu.Lock()
+	defer d.state.mu.Unlock()
+
+	st := d.state
+	stats := Stats{
+		Name:   d.stageName(),
+		Status: st.status,
+		InLen:  len(st.in),
+		InCap:  cap(st.in),
+	}
+	if st.in == nil {
+		stats.InCap = d.opts.inBuffer
+	}
+
+	st.stats.fill(&stats)
+
+	switch {
+	case st.startedAt.IsZero():
+	case st.stoppedAt.IsZero():
+		stats.Uptime = time.Since(st.startedAt)
+	default:
+		stats.Uptime = st.stoppedAt.Sub(st.startedAt)
+	}
+
+	return stats, st.stats
+}
+
+// Stats of a connector add up the stats of its stages: the messages come in
+// through the first stage and out through the last one
+func (d *daemonsConnectorInstance) Stats() Stats {
+	from, to := d.from.Stats(), d.to.Stats()
+
+	stats := Stats{
+		Name:        d.Name(),
+		Status:      d.Status(),
+		MessagesIn:  from.MessagesIn,
+		MessagesOut: to.MessagesOut,
+		Errors:      from.Errors + to.Errors,
+		LastError:   to.LastError,
+		InLen:       from.InLen,
+		InCap:       from.InCap,
+		InFlight:    from.InFlight + to.InFlight,
+		Uptime:      from.Uptime,
+	}
+	if stats.LastError == nil {
+		stats.LastError = from.LastError
+	}
+	if to.Uptime > stats.Uptime {
+		stats.Uptime = to.Uptime
+	}
+
+	for _, s := range []Stats{from, to} {
+		if len(s.Stages) > 0 {
+			stats.Stages = append(stats.Stages, s.Stages...)
+		} else {
+			stats.Stages = append(stats.Stages, s)
+		}
+	}
+
+	return stats
+}
+
+// addStats adds the stats of the workers to the stats of the cluster. The cluster
+// counts the messages it takes, the workers emit the outputs, so the outputs,
+// errors and calls of the workers are added up, the stopped workers included.
+func (c *clusterWorkers) addStats(stats *Stats) {
+	c.mu.Lock()
+	workers := make([]Daemon, len(c.workers))
+	for i, w := range c.workers {
+		workers[i] = w.daemon
+	}
+	exited := c.exited
+	c.mu.Unlock()
+
+	stats.MessagesOut += exited.MessagesOut
+	stats.Errors += exited.Errors
+	if stats.LastError == nil {
+		stats.LastError = exited.LastError
+	}
+
+	stats.addWorkers(workers)
+}
+
+// addWorkers adds up the outputs, errors and calls of the workers and lists their stats
+func (s *Stats) addWorkers(workers []Daemon) {
+	for _, w := range workers {
+		ws := w.Stats()
+		s.MessagesOut += ws.MessagesOut
+		s.Errors += ws.Errors
+		s.InFlight += ws.InFlight
+		if s.LastError == nil {
+			s.LastError = ws.LastError
+		}
+		s.Workers = append(s.Workers, ws)
+	}
+}
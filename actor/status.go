@@ -0,0 +1,74 @@
+package actor
+
+// Status is a step of the daemon lifecycle:
+// Created -> Starting -> Running -> Draining -> Stopped/Failed
+type Status int32
+
+const (
+	StatusCreated Status = iota
+	StatusStarting
+	StatusRunning
+	StatusDraining
+	StatusStopped
+	StatusFailed
+)
+
+func (s Status) String() string {
+	switch s {
+	case StatusCreated:
+		return "created"
+	case StatusStarting:
+		return "starting"
+	case StatusRunning:
+		return "running"
+	case StatusDraining:
+		return "draining"
+	case StatusStopped:
+		return "stopped"
+	case StatusFailed:
+		return "failed"
+	}
+	return "unknown"
+}
+
+func (s Status) IsActive() bool {
+	return s == StatusStarting || s == StatusRunning || s == StatusDraining
+}
+
+func (s Status) IsDone() bool {
+	return s == StatusStopped || s == StatusFailed
+}
+
+// combineStatus returns the status of a daemon built of several stages
+func combineStatus(statuses ...Status) Status {
+	var created, done, failed, starting, draining int
+	for _, s := range statuses {
+		switch s {
+		case StatusCreated:
+			created++
+		case StatusStarting:
+			starting++
+		case StatusDraining:
+			draining++
+		case StatusFailed:
+			failed++
+			done++
+		case StatusStopped:
+			done++
+		}
+	}
+
+	switch {
+	case failed > 0:
+		return StatusFailed
+	case created == len(statuses):
+		return StatusCreated
+	case done == len(statuses):
+		return StatusStopped
+	case starting > 0 || created > 0:
+		return StatusStarting
+	case draining > 0:
+		return StatusDraining
+	}
+	return StatusRunning
+}
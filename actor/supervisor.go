@@ -0,0 +1,303 @@
+package actor
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// RestartStrategy selects which children are restarted when one of them fails
+type RestartStrategy int
+
+const (
+	// OneForOne restarts only the failed child
+	OneForOne RestartStrategy = iota
+	// OneForAll restarts every child
+	OneForAll
+	// RestForOne restarts the failed child and the children after it
+	RestForOne
+)
+
+var ErrorRestartIntensity = fmt.Errorf("restart intensity exceeded")
+
+type SupervisorOption func(o *supervisorOptions)
+
+type supervisorOptions struct {
+	strategy    RestartStrategy
+	maxRestarts int
+	window      time.Duration
+	minBackoff  time.Duration
+	maxBackoff  time.Duration
+	daemonOpts  []DaemonOption
+}
+
+func WithRestartStrategy(strategy RestartStrategy) SupervisorOption {
+	return func(o *supervisorOptions) {
+		o.strategy = strategy
+	}
+}
+
+// WithMaxRestarts limits restarts to maxRestarts per window. When the limit is
+// exceeded the supervisor stops its children and fails with ErrorRestartIntensity,
+// so the failure escalates to the parent.
+func WithMaxRestarts(maxRestarts int, window time.Duration) SupervisorOption {
+	return func(o *supervisorOptions) {
+		o.maxRestarts = maxRestarts
+		o.window = window
+	}
+}
+
+// WithBackoff sets the delay before a restart. It starts at min and doubles
+// with every restart within the window up to max.
+func WithBackoff(min, max time.Duration) SupervisorOption {
+	return func(o *supervisorOptions) {
+		o.minBackoff = min
+		o.maxBackoff = max
+	}
+}
+
+// WithSupervisorDaemonOptions sets the options of the supervisor daemon itself
+func WithSupervisorDaemonOptions(opts ...DaemonOption) SupervisorOption {
+	return func(o *supervisorOptions) {
+		o.daemonOpts = append(o.daemonOpts, opts...)
+	}
+}
+
+type supervisedChild struct {
+	prototype  Daemon
+	running    Daemon
+	cancel     context.CancelFunc
+	generation int
+	alive      bool
+	finished   bool
+}
+
+type childExit struct {
+	index      int
+	generation int
+	err        error
+}
+
+// NewSupervisor runs children connected into a chain, like ConnectDaemon does,
+// and restarts the failed ones. Channels between the children are owned by the
+// supervisor, so restarted children get the same in/out channels.
+// Child failures go to the supervisor error policy after the restart, so
+// a blocking policy doesn't hold the restart back.
+func NewSupervisor(children []Daemon, opts ...SupervisorOption) Daemon {
+	o := supervisorOptions{
+		strategy:    OneForOne,
+		maxRestarts: 3,
+		window:      5 * time.Second,
+		minBackoff:  10 * time.Millisecond,
+		maxBackoff:  time.Second,
+	}
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	fn := DaemonFn(func(ctx context.Context, in chan interface{}, out chan interface{}, errChan chan error) error {
+		s := &supervisor{
+			opts:     o,
+			children: make([]*supervisedChild, len(children)),
+			chans:    make([]chan interface{}, len(children)+1),
+			errChan:  errChan,
+			exits:    make(chan childExit),
+			done:     make(chan struct{}),
+		}
+		defer close(s.done)
+
+		s.chans[0] = in
+		s.chans[len(children)] = out
+		for i := 1; i < len(children); i++ {
+			s.chans[i] = make(chan interface{})
+		}
+
+		for i, child := range children {
+			s.children[i] = &supervisedChild{prototype: child}
+			if err := s.start(ctx, i); err != nil {
+				s.stopAll()
+				return err
+			}
+		}
+
+		return s.loop(ctx)
+	})
+
+	return NewDaemon(fn, o.daemonOpts...).(*daemonPrototype).withTopology(func(t *topologyBuilder, d *daemonPrototype) *describedNode {
+		return t.describeSupervisor(d, children)
+	})
+}
+
+type supervisor struct {
+	opts     supervisorOptions
+	children []*supervisedChild
+	chans    []chan interface{}
+	errChan  chan error
+	exits    chan childExit
+	done     chan struct{}
+	restarts []time.Time
+}
+
+func (s *supervisor) loop(ctx context.Context) error {
+	for s.alive() > 0 {
+		select {
+		case <-ctx.Done():
+			s.stopAll()
+			return nil
+
+		case e := <-s.exits:
+			c := s.children[e.index]
+			if e.generation != c.generation {
+				// stopped by the supervisor for a restart
+				continue
+			}
+			c.alive = false
+
+			if e.err == nil {
+				c.finished = true
+				// the next child sees the end of the stream
+				if e.index+1 < len(s.children) {
+					close(s.chans[e.index+1])
+				}
+				continue
+			}
+
+			if err := s.restart(ctx, e.index, e.err); err != nil {
+				s.stopAll()
+				return err
+			}
+
+			// the policy may wait for a reader of Err(), the children keep running meanwhile.
+			// The report gives up when the supervisor stops and its context is released.
+			go reportError(ctx, s.errChan, e.err)
+		}
+	}
+
+	return nil
+}
+
+func (s *supervisor) alive() int {
+	var alive int
+	for _, c := range s.children {
+		if c.alive {
+			alive++
+		}
+	}
+	return alive
+}
+
+func (s *supervisor) start(ctx context.Context, i int) error {
+	c := s.children[i]
+
+	d := c.prototype.Clone()
+	d.DisableCloseChannelsOnStop(true)
+	d.SetIn(s.chans[i])
+	d.SetOut(s.chans[i+1])
+	d.SetErr(s.errChan)
+
+	childCtx, cancel := context.WithCancel(withSupervised(ctx, true))
+	running, err := d.Run(childCtx)
+	if err != nil {
+		cancel()
+		return err
+	}
+
+	c.generation++
+	c.running = running
+	c.cancel = cancel
+	c.alive = true
+
+	go func(generation int) {
+		err := running.WaitErr()
+		select {
+		case s.exits <- childExit{index: i, generation: generation, err: err}:
+		case <-s.done:
+		}
+	}(c.generation)
+
+	return nil
+}
+
+func (s *supervisor) stop(i int) {
+	c := s.children[i]
+	if !c.alive {
+		return
+	}
+
+	// the exit of this generation is ignored by the loop
+	c.generation++
+	c.alive = false
+	c.cancel()
+	c.running.Wait()
+}
+
+func (s *supervisor) stopAll() {
+	for i := range s.children {
+		s.stop(i)
+	}
+}
+
+func (s *supervisor) restart(ctx context.Context, failed int, cause error) error {
+	now := time.Now()
+
+	recent := s.restarts[:0]
+	for _, t := range s.restarts {
+		if now.Sub(t) < s.opts.window {
+			recent = append(recent, t)
+		}
+	}
+	s.restarts = append(recent, now)
+
+	if len(s.restarts) > s.opts.maxRestarts {
+		return fmt.Errorf("%w: %w", ErrorRestartIntensity, cause)
+	}
+
+	var restart []int
+	for i, c := range s.children {
+		if c.finished {
+			continue
+		}
+
+		switch {
+		case i == failed,
+			s.opts.strategy == OneForAll,
+			s.opts.strategy == RestForOne && i > failed:
+			restart = append(restart, i)
+		}
+	}
+
+	for _, i := range restart {
+		s.stop(i)
+	}
+
+	backoff := s.opts.minBackoff
+	for i := 1; i < len(s.restarts) && backoff < s.opts.maxBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > s.opts.maxBackoff {
+		backoff = s.opts.maxBackoff
+	}
+
+	if logger := stageLogger(ctx); logger != nil {
+		names := make([]string, len(restart))
+		for j, i := range restart {
+			names[j] = stageLabel(s.children[i].prototype)
+		}
+		logger.Warn("restarting children", "failed", stageLabel(s.children[failed].prototype),
+			"children", names, "backoff", backoff, "err", cause)
+	}
+
+	select {
+	case <-ctx.Done():
+		return nil
+	case <-time.After(backoff):
+	}
+
+	for _, i := range restart {
+		if err := s.start(ctx, i); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
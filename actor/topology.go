@@ -0,0 +1,443 @@
+package actor
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// Kinds of the topology nodes
+const (
+	KindActor     = "actor"
+	KindDaemon    = "daemon"
+	KindConnector = "connector"
+	KindCluster   = "cluster"
+	KindGraph     = "graph"
+	// the routing stages are boxes with the stage itself and the stages it routes to
+	KindRouter     = "router"
+	KindMerge      = "merge"
+	KindBroadcast  = "broadcast"
+	KindSupervisor = "supervisor"
+)
+
+// Topology is the structure of a pipeline: a tree of stages and the edges
+// the messages take between the leaf stages
+type Topology struct {
+	Root  *TopologyNode
+	Edges []TopologyEdge
+}
+
+// TopologyNode is a stage of the pipeline
+type TopologyNode struct {
+	// ID is unique within the topology
+	ID   string
+	Kind string
+	Name string
+	// Workers is the number of workers of a cluster, the worker is its only child
+	Workers int
+	// InCap and OutCap are the capacities of the stage channels. A not launched
+	// stage reports the buffers its channels will be created with.
+	InCap  int
+	OutCap int
+
+	Children []*TopologyNode
+}
+
+type TopologyEdge struct {
+	From string
+	To   string
+	// Label names the ports of a graph edge
+	Label string
+}
+
+// describer is implemented by the stages made of other stages
+type describer interface {
+	describe(t *topologyBuilder) *describedNode
+}
+
+// describedNode is a node with the leaf nodes the messages enter and leave it through
+type describedNode struct {
+	*TopologyNode
+
+	entries []string
+	exits   []string
+}
+
+type topologyBuilder struct {
+	topology *Topology
+	nextID   int
+}
+
+// Describe returns the topology of an Actor or a Daemon: the stages of the connectors,
+// clusters and graphs inside it with their names, worker counts and channel capacities
+func Describe(stage interface{}) *Topology {
+	t := &topologyBuilder{topology: &Topology{}}
+	t.topology.Root = t.describe(stage).TopologyNode
+	return t.topology
+}
+
+func (t *topologyBuilder) describe(stage interface{}) *describedNode {
+	switch s := stage.(type) {
+	case describer:
+		return s.describe(t)
+	case Daemon:
+		return t.leaf(KindDaemon, stageLabel(s), cap(s.In()), cap(s.Out()))
+	case DaemonFactory:
+		// the worker of a factory isn't known until the factory is called
+		return t.leaf(KindDaemon, shortName(s), 0, 0)
+	default:
+		return t.leaf(KindActor, shortName(stage), 0, 0)
+	}
+}
+
+func (t *topologyBuilder) node(kind string, name string) *TopologyNode {
+	n := &TopologyNode{
+		ID:   fmt.Sprintf("n%d", t.nextID),
+		Kind: kind,
+		Name: name,
+	}
+	t.nextID++
+	return n
+}
+
+func (t *topologyBuilder) leaf(kind string, name string, inCap int, outCap int) *describedNode {
+	n := t.node(kind, name)
+	n.InCap, n.OutCap = inCap, outCap
+	return &describedNode{TopologyNode: n, entries: []string{n.ID}, exits: []string{n.ID}}
+}
+
+// connect adds the edges from the exits of from to the entries of to
+func (t *topologyBuilder) connect(from *describedNode, to *describedNode, label string) {
+	for _, exit := range from.exits {
+		for _, entry := range to.entries {
+			t.topology.Edges = append(t.topology.Edges, TopologyEdge{From: exit, To: entry, Label: label})
+		}
+	}
+}
+
+// shortName returns the name of a function without the package path
+func shortName(stage interface{}) string {
+	if reflect.ValueOf(stage).Kind() != reflect.Func {
+		return fmt.Sprintf("%T", stage)
+	}
+
+	name := funcName(stage)
+	return name[strings.LastIndex(name, "/")+1:]
+}
+
+// withTopology sets how Describe shows the stages the daemon runs inside it
+func (d *daemonPrototype) withTopology(topology func(t *topologyBuilder, d *daemonPrototype) *describedNode) *daemonPrototype {
+	d.topology = topology
+	return d
+}
+
+func (d *daemonPrototype) describe(t *topologyBuilder) *describedNode {
+	if d.topology != nil {
+		return d.topology(t, d)
+	}
+	return d.describeLeaf(t)
+}
+
+// describeLeaf describes the daemon without the stages inside it
+func (d *daemonPrototype) describeLeaf(t *topologyBuilder) *describedNode {
+	name := d.Name()
+	if name == "" {
+		name = shortName(d.fn)
+	}
+
+	inCap, outCap := d.opts.inBuffer, d.opts.outBuffer
+	if in := d.In(); in != nil {
+		inCap = cap(in)
+	}
+	if out := d.Out(); out != nil {
+		outCap = cap(out)
+	}
+
+	return t.leaf(KindDaemon, name, inCap, outCap)
+}
+
+func (d *daemonsConnectorInstance) describe(t *topologyBuilder) *describedNode {
+	return t.describeConnector(d.Name(), d.from, d.to)
+}
+
+func (c *actorsConnectorInstance) describe(t *topologyBuilder) *describedNode {
+	return t.describeConnector("", c.from, c.to)
+}
+
+func (t *topologyBuilder) describeConnector(name string, from interface{}, to interface{}) *describedNode {
+	n := t.node(KindConnector, name)
+	f, s := t.describe(from), t.describe(to)
+	t.connect(f, s, "")
+
+	n.InCap, n.OutCap = f.InCap, s.OutCap
+	n.Children = []*TopologyNode{f.TopologyNode, s.TopologyNode}
+
+	return &describedNode{TopologyNode: n, entries: f.entries, exits: s.exits}
+}
+
+func (c *daemonsCluster) describe(t *topologyBuilder) *describedNode {
+	// a running cluster shows its worker, a not launched one the daemon it clones.
+	// The factory isn't called, the worker it creates is shown by the factory name.
+	var worker interface{} = c.daemon
+	if c.workers != nil {
+		c.workers.mu.Lock()
+		if len(c.workers.workers) > 0 {
+			worker = c.workers.workers[0].daemon
+		}
+		c.workers.mu.Unlock()
+	}
+	if worker == nil {
+		worker = c.factory
+	}
+
+	return t.describeCluster(c.daemonPrototype, c.Size(), worker)
+}
+
+// describeCluster describes a cluster of size workers like worker, the worker is its only child
+func (t *topologyBuilder) describeCluster(d *daemonPrototype, size int, worker interface{}) *describedNode {
+	n := d.describeLeaf(t)
+	n.Kind, n.Name = KindCluster, d.Name()
+	n.Workers = size
+	if worker == nil {
+		return n
+	}
+
+	w := t.describe(worker)
+	n.Children = []*TopologyNode{w.TopologyNode}
+	n.entries, n.exits = w.entries, w.exits
+
+	return n
+}
+
+// describeRouting describes a stage passing the messages between its own node and
+// the inner stages. The own node is the first child, named after the kind.
+func (t *topologyBuilder) describeRouting(d *daemonPrototype, kind string) (n *describedNode, self *describedNode) {
+	n = d.describeLeaf(t)
+	n.Kind, n.Name = kind, d.Name()
+
+	self = t.leaf(KindDaemon, kind, n.InCap, n.OutCap)
+	n.Children = []*TopologyNode{self.TopologyNode}
+
+	return n, self
+}
+
+func (t *topologyBuilder) describeRouter(d *daemonPrototype, branches map[string]Daemon) *describedNode {
+	n, self := t.describeRouting(d, KindRouter)
+	n.entries, n.exits = self.entries, nil
+
+	names := make([]string, 0, len(branches))
+	for name := range branches {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		b := t.describe(branches[name])
+		b.Name = name
+		n.Children = append(n.Children, b.TopologyNode)
+		t.connect(self, b, name)
+
+		// branches with their own output don't write to the router output
+		if branches[name].Out() == nil {
+			n.exits = append(n.exits, b.exits...)
+		}
+	}
+
+	return n
+}
+
+func (t *topologyBuilder) describeMerge(d *daemonPrototype, upstreams []Daemon) *describedNode {
+	n, self := t.describeRouting(d, KindMerge)
+	n.entries, n.exits = self.entries, self.exits
+
+	for _, upstream := range upstreams {
+		u := t.describe(upstream)
+		n.Children = append(n.Children, u.TopologyNode)
+		t.connect(u, self, "")
+	}
+
+	return n
+}
+
+func (t *topologyBuilder) describeBroadcast(d *daemonPrototype, subscribers []Daemon) *describedNode {
+	// the subscribers keep their own outputs
+	n, self := t.describeRouting(d, KindBroadcast)
+	n.entries, n.exits = self.entries, nil
+
+	for _, subscriber := range subscribers {
+		s := t.describe(subscriber)
+		n.Children = append(n.Children, s.TopologyNode)
+		t.connect(self, s, "")
+	}
+
+	return n
+}
+
+func (t *topologyBuilder) describeSupervisor(d *daemonPrototype, children []Daemon) *describedNode {
+	n := d.describeLeaf(t)
+	n.Kind, n.Name = KindSupervisor, d.Name()
+	n.entries, n.exits = nil, nil
+
+	// the children are connected into a chain
+	var prev *describedNode
+	for _, child := range children {
+		c := t.describe(child)
+		n.Children = append(n.Children, c.TopologyNode)
+		if prev != nil {
+			t.connect(prev, c, "")
+		} else {
+			n.entries = c.entries
+		}
+		n.exits, prev = c.exits, c
+	}
+
+	return n
+}
+
+func (t *topologyBuilder) describeGraph(d *daemonPrototype, g *graphInstance) *describedNode {
+	n := d.describeLeaf(t)
+	n.Kind, n.Name = KindGraph, d.Name()
+	n.entries, n.exits = nil, nil
+
+	nodes := make(map[string]*describedNode, len(g.names))
+	for _, name := range g.names {
+		nodes[name] = t.describe(g.nodes[name])
+		nodes[name].Name = name
+		n.Children = append(n.Children, nodes[name].TopologyNode)
+	}
+
+	for _, e := range g.edges {
+		from, to := nodes[e.from.node], nodes[e.to.node]
+		switch {
+		case e.from.node == GraphInput && to != nil:
+			n.entries = append(n.entries, to.entries...)
+		case e.to.node == GraphOutput && from != nil:
+			n.exits = append(n.exits, from.exits...)
+		case from != nil && to != nil:
+			t.connect(from, to, e.label())
+		}
+	}
+
+	return n
+}
+
+func (g *graphInstance) describe(t *topologyBuilder) *describedNode {
+	return g.AsDaemon().(*daemonPrototype).describe(t)
+}
+
+// label names the ports of the edge other than the default ones
+func (e graphEdge) label() string {
+	var ports []string
+	if e.from.port != PortOut {
+		ports = append(ports, e.from.port)
+	}
+	if e.to.port != PortIn {
+		ports = append(ports, e.to.port)
+	}
+	return strings.Join(ports, " -> ")
+}
+
+// label describes the node in the diagrams
+func (n *TopologyNode) label() string {
+	label := n.Name
+	if label == "" {
+		label = n.Kind
+	}
+	if n.Workers > 0 {
+		label += fmt.Sprintf("\nworkers: %d", n.Workers)
+	}
+	if n.Kind != KindActor && n.Kind != KindConnector {
+		label += fmt.Sprintf("\nin: %d out: %d", n.InCap, n.OutCap)
+	}
+	return label
+}
+
+// DOT renders the topology in the Graphviz DOT language. Clusters
+// and graphs are drawn as boxes around their stages.
+func (t *Topology) DOT() string {
+	b := &strings.Builder{}
+	b.WriteString("digraph pipeline {\n")
+	b.WriteString("\tnode [shape=box];\n")
+
+	var write func(n *TopologyNode, indent string)
+	write = func(n *TopologyNode, indent string) {
+		switch {
+		case len(n.Children) == 0:
+			fmt.Fprintf(b, "%s%s [label=%s];\n", indent, n.ID, dotQuote(n.label()))
+		case n.Kind == KindConnector:
+			for _, c := range n.Children {
+				write(c, indent)
+			}
+		default:
+			fmt.Fprintf(b, "%ssubgraph cluster_%s {\n", indent, n.ID)
+			fmt.Fprintf(b, "%s\tlabel=%s;\n", indent, dotQuote(n.label()))
+			for _, c := range n.Children {
+				write(c, indent+"\t")
+			}
+			fmt.Fprintf(b, "%s}\n", indent)
+		}
+	}
+	if t.Root != nil {
+		write(t.Root, "\t")
+	}
+
+	for _, e := range t.Edges {
+		if e.Label != "" {
+			fmt.Fprintf(b, "\t%s -> %s [label=%s];\n", e.From, e.To, dotQuote(e.Label))
+		} else {
+			fmt.Fprintf(b, "\t%s -> %s;\n", e.From, e.To)
+		}
+	}
+
+	b.WriteString("}\n")
+	return b.String()
+}
+
+// Mermaid renders the topology as a Mermaid flowchart
+func (t *Topology) Mermaid() string {
+	b := &strings.Builder{}
+	b.WriteString("flowchart LR\n")
+
+	var write func(n *TopologyNode, indent string)
+	write = func(n *TopologyNode, indent string) {
+		switch {
+		case len(n.Children) == 0:
+			fmt.Fprintf(b, "%s%s[%s]\n", indent, n.ID, mermaidQuote(n.label()))
+		case n.Kind == KindConnector:
+			for _, c := range n.Children {
+				write(c, indent)
+			}
+		default:
+			fmt.Fprintf(b, "%ssubgraph %s [%s]\n", indent, n.ID, mermaidQuote(n.label()))
+			for _, c := range n.Children {
+				write(c, indent+"    ")
+			}
+			fmt.Fprintf(b, "%send\n", indent)
+		}
+	}
+	if t.Root != nil {
+		write(t.Root, "    ")
+	}
+
+	for _, e := range t.Edges {
+		if e.Label != "" {
+			fmt.Fprintf(b, "    %s -->|%s| %s\n", e.From, mermaidQuote(e.Label), e.To)
+		} else {
+			fmt.Fprintf(b, "    %s --> %s\n", e.From, e.To)
+		}
+	}
+
+	return b.String()
+}
+
+func dotQuote(s string) string {
+	s = strings.ReplaceAll(s, `\`, `\\`)
+	s = strings.ReplaceAll(s, `"`, `\"`)
+	return `"` + strings.ReplaceAll(s, "\n", `\n`) + `"`
+}
+
+func mermaidQuote(s string) string {
+	s = strings.ReplaceAll(s, `"`, "#quot;")
+	return `"` + strings.ReplaceAll(s, "\n", "<br/>") + `"`
+}
@@ -0,0 +1,254 @@
+package actor
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"sync"
+	"time"
+)
+
+// Kinds of the spans
+const (
+	// SpanCall is an actor call
+	SpanCall = "call"
+	// SpanHop is the time an enveloped message takes from the stage that emitted it to the next one
+	SpanHop = "hop"
+)
+
+// Span is a timed step of a message through the pipeline. Every actor call of a daemon
+// makes a span. The spans of an enveloped message form a trace: the envelope carries
+// the trace context, so every call is the child of the hop that brought the message,
+// and the hop is the child of the previous call. Plain messages aren't linked.
+type Span struct {
+	TraceID  string
+	SpanID   string
+	ParentID string
+	Kind     string
+	// Name is the stage name, from -> to for the hops
+	Name string
+	// Worker is the cluster worker ID, -1 outside of a cluster
+	Worker int
+	Start  time.Time
+	End    time.Time
+	Err    error
+}
+
+// SpanExporter receives the finished spans. It's called from all the stages at once.
+type SpanExporter interface {
+	ExportSpan(span Span)
+}
+
+type SpanExporterFn func(span Span)
+
+func (fn SpanExporterFn) ExportSpan(span Span) {
+	fn(span)
+}
+
+// ContextWithSpanExporter traces the daemons run with ctx unless WithSpanExporter is set
+func ContextWithSpanExporter(ctx context.Context, exporter SpanExporter) context.Context {
+	return withStageSetting(ctx, func(s *stage) {
+		s.spans = exporter
+	})
+}
+
+// startSpan starts the span of an actor call, nil when the stage has no span exporter.
+// The envelope gets the span as the parent of the outputs.
+func startSpan(ctx context.Context, stage string, e *Envelope, start time.Time) *Span {
+	exporter := stageFromContext(ctx).spans
+	if exporter == nil {
+		return nil
+	}
+
+	span := &Span{
+		TraceID: newTraceID(),
+		SpanID:  newSpanID(),
+		Kind:    SpanCall,
+		Name:    stage,
+		Worker:  WorkerID(ctx),
+		Start:   start,
+	}
+	if e == nil {
+		return span
+	}
+
+	if e.TraceID == "" {
+		e.TraceID = span.TraceID
+	}
+	span.TraceID, span.ParentID = e.TraceID, e.SpanID
+
+	if e.SpanID != "" && !e.sent.IsZero() {
+		hop := Span{
+			TraceID:  e.TraceID,
+			SpanID:   newSpanID(),
+			ParentID: e.SpanID,
+			Kind:     SpanHop,
+			Name:     e.from + " -> " + stage,
+			Worker:   span.Worker,
+			Start:    e.sent,
+			End:      start,
+		}
+		exporter.ExportSpan(hop)
+		span.ParentID = hop.SpanID
+	}
+
+	e.SpanID = span.SpanID
+	return span
+}
+
+// finish exports the span and marks the envelope of the outputs as sent by the span stage
+func (s *Span) finish(ctx context.Context, e *Envelope, err error) {
+	if s == nil {
+		return
+	}
+
+	s.End, s.Err = time.Now(), err
+	if isEndOfStream(err) {
+		s.Err = nil
+	}
+	stageFromContext(ctx).spans.ExportSpan(*s)
+
+	if e != nil {
+		e.from, e.sent = s.Name, s.End
+	}
+}
+
+func newTraceID() string {
+	return randomID(16)
+}
+
+func newSpanID() string {
+	return randomID(8)
+}
+
+// InMemoryExporter keeps the exported spans, e.g. for tests
+type InMemoryExporter interface {
+	SpanExporter
+
+	// Spans returns the spans in the order they were exported
+	Spans() []Span
+	Reset()
+}
+
+type inMemoryExporterInstance struct {
+	mu    sync.Mutex
+	spans []Span
+}
+
+func NewInMemoryExporter() InMemoryExporter {
+	return &inMemoryExporterInstance{}
+}
+
+func (e *inMemoryExporterInstance) ExportSpan(span Span) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	e.spans = append(e.spans, span)
+}
+
+func (e *inMemoryExporterInstance) Spans() []Span {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	return append([]Span(nil), e.spans...)
+}
+
+func (e *inMemoryExporterInstance) Reset() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	e.spans = nil
+}
+
+// ChromeTraceExporter writes the spans in the Chrome trace event format,
+// which chrome://tracing and Perfetto open. Every stage gets its own track.
+type ChromeTraceExporter interface {
+	SpanExporter
+
+	// Close writes the collected spans and closes the writer if it's an io.Closer
+	Close() error
+}
+
+type chromeTraceExporterInstance struct {
+	w io.Writer
+
+	mu     sync.Mutex
+	events []chromeTraceEvent
+	tracks map[string]int
+}
+
+type chromeTraceEvent struct {
+	Name     string            `json:"name"`
+	Category string            `json:"cat,omitempty"`
+	Phase    string            `json:"ph"`
+	Time     int64             `json:"ts"`
+	Duration int64             `json:"dur"`
+	Process  int               `json:"pid"`
+	Thread   int               `json:"tid"`
+	Args     map[string]string `json:"args,omitempty"`
+}
+
+func NewChromeTraceExporter(w io.Writer) ChromeTraceExporter {
+	return &chromeTraceExporterInstance{
+		w:      w,
+		tracks: make(map[string]int),
+	}
+}
+
+func (e *chromeTraceExporterInstance) ExportSpan(span Span) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	track, ok := e.tracks[span.Name]
+	if !ok {
+		track = len(e.tracks) + 1
+		e.tracks[span.Name] = track
+
+		e.events = append(e.events, chromeTraceEvent{
+			Name:    "thread_name",
+			Phase:   "M",
+			Process: 1,
+			Thread:  track,
+			Args:    map[string]string{"name": span.Name},
+		})
+	}
+
+	args := map[string]string{
+		"trace_id": span.TraceID,
+		"span_id":  span.SpanID,
+	}
+	if span.ParentID != "" {
+		args["parent_id"] = span.ParentID
+	}
+	if span.Err != nil {
+		args["error"] = span.Err.Error()
+	}
+
+	e.events = append(e.events, chromeTraceEvent{
+		Name:     span.Name,
+		Category: span.Kind,
+		Phase:    "X",
+		Time:     span.Start.UnixMicro(),
+		Duration: span.End.Sub(span.Start).Microseconds(),
+		Process:  1,
+		Thread:   track,
+		Args:     args,
+	})
+}
+
+func (e *chromeTraceExporterInstance) Close() error {
+	e.mu.Lock()
+	events := append([]chromeTraceEvent{}, e.events...)
+	e.mu.Unlock()
+
+	err := json.NewEncoder(e.w).Encode(struct {
+		TraceEvents []chromeTraceEvent `json:"traceEvents"`
+	}{events})
+
+	if c, ok := e.w.(io.Closer); ok {
+		if closeErr := c.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	return err
+}
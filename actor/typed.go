@@ -0,0 +1,288 @@
+package actor
+
+import "context"
+
+// Typed layer over ActorFn/DaemonFn. Typed stages are ordinary Actors and
+// Daemons, so they can be mixed with untyped ones; the type assertions happen
+// once at the boundary instead of inside every stage.
+
+type TypedActorFn[In, Out any] func(ctx context.Context, in In) (out Out, err error)
+
+type TypedActor[In, Out any] interface {
+	Actor
+	CallTyped(ctx context.Context, in In) (out Out, err error)
+	AsTypedDaemon(opts ...DaemonOption) TypedDaemon[In, Out]
+}
+
+type TypedDaemonFn[In, Out any] func(ctx context.Context, in chan In, out chan Out, err chan error) error
+
+type TypedDaemon[In, Out any] interface {
+	Daemon
+	RunTyped(ctx context.Context) (TypedDaemon[In, Out], error)
+	Send(ctx context.Context, in In) error
+	Receive(ctx context.Context) (out Out, err error)
+}
+
+func (fn TypedActorFn[In, Out]) CallTyped(ctx context.Context, in In) (out Out, err error) {
+	return fn(ctx, in)
+}
+
+func (fn TypedActorFn[In, Out]) AsActorFn() ActorFn {
+	return func(ctx context.Context, in interface{}) (out interface{}, err error) {
+		typedIn, ok := in.(In)
+		if !ok {
+			return nil, ErrorInputFormat
+		}
+
+		typedOut, err := fn(ctx, typedIn)
+		if err != nil {
+			return nil, err
+		}
+
+		return typedOut, nil
+	}
+}
+
+func (fn TypedActorFn[In, Out]) AsActor() Actor {
+	return fn
+}
+
+func (fn TypedActorFn[In, Out]) Call(ctx context.Context, in interface{}) (out interface{}, err error) {
+	return fn.AsActorFn().Call(ctx, in)
+}
+
+func (fn TypedActorFn[In, Out]) ConnectActor(actor Actor) Actor {
+	return NewActorsConnector(fn, actor)
+}
+
+func (fn TypedActorFn[In, Out]) ConnectDaemon(daemon Daemon) Daemon {
+	return NewActorDaemonConnector(fn, daemon)
+}
+
+func (fn TypedActorFn[In, Out]) AsTypedDaemon(opts ...DaemonOption) TypedDaemon[In, Out] {
+	return AsTypedDaemon[In, Out](fn.AsActorFn().AsDaemon(opts...))
+}
+
+func (fn TypedDaemonFn[In, Out]) AsDaemonFn() DaemonFn {
+	return func(ctx context.Context, in chan interface{}, out chan interface{}, errChan chan error) error {
+		typedIn := make(chan In)
+		typedOut := make(chan Out)
+		done := make(chan struct{})
+
+		pumped := make(chan struct{})
+		go func() {
+			defer close(pumped)
+			pumpTyped(ctx, in, out, errChan, typedIn, typedOut, done)
+		}()
+
+		err := fn(ctx, typedIn, typedOut, errChan)
+		close(done)
+		close(typedOut)
+		<-pumped
+
+		return err
+	}
+}
+
+// pumpTyped passes the payloads of the inputs to fn and the outputs of fn back until
+// typedOut is closed. Both directions go through one goroutine, so an output is put
+// into the envelope of the last input fn has taken.
+func pumpTyped[In, Out any](ctx context.Context, in chan interface{}, out chan interface{}, errChan chan error, typedIn chan In, typedOut chan Out, done chan struct{}) {
+	input, ctxDone := in, ctx.Done()
+	var send chan In
+	var next In
+	var nextEnvelope, current *Envelope
+
+	var inClosed bool
+	closeIn := func() {
+		input, send = nil, nil
+		if !inClosed {
+			inClosed = true
+			close(typedIn)
+		}
+	}
+
+	for {
+		// once fn has returned the input is left to the other readers
+		select {
+		case <-done:
+			closeIn()
+		default:
+		}
+
+		select {
+		case <-ctxDone:
+			ctxDone = nil
+			closeIn()
+
+		case inData, ok := <-input:
+			if !ok {
+				closeIn()
+				continue
+			}
+
+			_, payload, e := openEnvelope(ctx, inData)
+			typed, ok := payload.(In)
+			if !ok {
+				reportError(ctx, errChan, newStageError(StageName(ctx), inData, ErrorInputFormat))
+				continue
+			}
+			next, nextEnvelope = typed, e
+			input, send = nil, typedIn
+
+		case send <- next:
+			current = nextEnvelope
+			input, send = in, nil
+
+		case outData, ok := <-typedOut:
+			if !ok {
+				return
+			}
+
+			// keep reading after cancel so fn never blocks on typedOut
+			select {
+			case <-ctx.Done():
+			case out <- current.seal(outData):
+			}
+		}
+	}
+}
+
+func (fn TypedDaemonFn[In, Out]) AsTypedDaemon(opts ...DaemonOption) TypedDaemon[In, Out] {
+	return NewTypedDaemon(fn, opts...)
+}
+
+// Typed view over an untyped actor
+type typedActor[In, Out any] struct {
+	Actor
+}
+
+func (a *typedActor[In, Out]) CallTyped(ctx context.Context, in In) (out Out, err error) {
+	return assertOut[Out](a.Call(ctx, in))
+}
+
+func (a *typedActor[In, Out]) AsTypedDaemon(opts ...DaemonOption) TypedDaemon[In, Out] {
+	return AsTypedDaemon[In, Out](a.AsActorFn().AsDaemon(opts...))
+}
+
+// Typed view over an untyped daemon
+type typedDaemon[In, Out any] struct {
+	Daemon
+}
+
+func (d *typedDaemon[In, Out]) Run(ctx context.Context) (Daemon, error) {
+	return d.RunTyped(ctx)
+}
+
+func (d *typedDaemon[In, Out]) RunTyped(ctx context.Context) (TypedDaemon[In, Out], error) {
+	dl, err := d.Daemon.Run(ctx)
+	if dl == nil {
+		return nil, err
+	}
+
+	return &typedDaemon[In, Out]{Daemon: dl}, err
+}
+
+func (d *typedDaemon[In, Out]) Clone() Daemon {
+	return &typedDaemon[In, Out]{Daemon: d.Daemon.Clone()}
+}
+
+func (d *typedDaemon[In, Out]) closeIn() {
+	closeDaemonIn(d.Daemon)
+}
+
+func (d *typedDaemon[In, Out]) closeOut() {
+	closeDaemonOut(d.Daemon)
+}
+
+func (d *typedDaemon[In, Out]) Send(ctx context.Context, in In) error {
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case d.In() <- in:
+		return nil
+	}
+}
+
+func (d *typedDaemon[In, Out]) Receive(ctx context.Context) (out Out, err error) {
+	select {
+	case <-ctx.Done():
+		return out, ctx.Err()
+	case outData, ok := <-d.Out():
+		if !ok {
+			return out, ErrorOutputClosed
+		}
+		return assertOut[Out](outData, nil)
+	}
+}
+
+func assertOut[Out any](out interface{}, err error) (typedOut Out, _ error) {
+	if err != nil {
+		return typedOut, err
+	}
+
+	typedOut, ok := out.(Out)
+	if !ok {
+		// the output of an enveloped input is enveloped too
+		typedOut, ok = Payload(out).(Out)
+	}
+	if !ok {
+		return typedOut, ErrorOutputFormat
+	}
+
+	return typedOut, nil
+}
+
+func NewTypedActor[In, Out any](fn TypedActorFn[In, Out]) TypedActor[In, Out] {
+	return fn
+}
+
+func NewTypedDaemon[In, Out any](fn TypedDaemonFn[In, Out], opts ...DaemonOption) TypedDaemon[In, Out] {
+	return &typedDaemon[In, Out]{Daemon: NewDaemon(fn.AsDaemonFn(), opts...)}
+}
+
+// AsTypedActor wraps an untyped actor. Input and output values are asserted
+// on every call and mismatches are returned as ErrorInputFormat/ErrorOutputFormat.
+func AsTypedActor[In, Out any](actor Actor) TypedActor[In, Out] {
+	if typed, ok := actor.(TypedActor[In, Out]); ok {
+		return typed
+	}
+
+	return &typedActor[In, Out]{Actor: actor}
+}
+
+// AsTypedDaemon wraps an untyped daemon. Out() values (the payloads of enveloped
+// ones) are asserted by Receive.
+func AsTypedDaemon[In, Out any](daemon Daemon) TypedDaemon[In, Out] {
+	if typed, ok := daemon.(TypedDaemon[In, Out]); ok {
+		return typed
+	}
+
+	return &typedDaemon[In, Out]{Daemon: daemon}
+}
+
+// The Connect helpers only compile when the output of from matches the input of to.
+
+func ConnectTypedActors[A, B, C any](from TypedActor[A, B], to TypedActor[B, C]) TypedActor[A, C] {
+	return &typedActor[A, C]{Actor: NewActorsConnector(from, to)}
+}
+
+func ConnectTypedDaemons[A, B, C any](from TypedDaemon[A, B], to TypedDaemon[B, C]) TypedDaemon[A, C] {
+	return &typedDaemon[A, C]{Daemon: NewDaemonsConnector(from, to)}
+}
+
+func ConnectTypedActorDaemon[A, B, C any](from TypedActor[A, B], to TypedDaemon[B, C]) TypedDaemon[A, C] {
+	return &typedDaemon[A, C]{Daemon: NewActorDaemonConnector(from, to)}
+}
+
+func ConnectTypedDaemonActor[A, B, C any](from TypedDaemon[A, B], to TypedActor[B, C]) TypedDaemon[A, C] {
+	return &typedDaemon[A, C]{Daemon: NewDaemonActorConnector(from, to)}
+}
+
+func (d *typedDaemon[In, Out]) describe(t *topologyBuilder) *describedNode {
+	return t.describe(d.Daemon)
+}
+
+func (a *typedActor[In, Out]) describe(t *topologyBuilder) *describedNode {
+	return t.describe(a.Actor)
+}